@@ -6,8 +6,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strconv"
 
 	"github.com/ezoidc/ezoidc/pkg/engine"
+	"github.com/ezoidc/ezoidc/pkg/krl"
 	"github.com/ezoidc/ezoidc/pkg/models"
 	"github.com/ezoidc/ezoidc/pkg/providers"
 	"github.com/ezoidc/ezoidc/pkg/server"
@@ -41,6 +43,12 @@ var startCmd = &cobra.Command{
 		level, _ := zerolog.ParseLevel(config.LogLevel)
 		log.Logger = log.Logger.Level(level)
 
+		providers.ConfigureKubernetesClusters(config.Clusters)
+		err = providers.ConfigureKubernetesClusterIssuers(ctx, config)
+		if err != nil {
+			return err
+		}
+
 		err = config.PreloadJWKS(ctx)
 		if err != nil {
 			return err
@@ -85,6 +93,7 @@ var testVariablesCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
+		providers.ConfigureKubernetesClusters(config.Clusters)
 
 		eng := engine.NewEngine(config)
 		err = eng.Compile(ctx)
@@ -105,6 +114,69 @@ var testVariablesCmd = &cobra.Command{
 	},
 }
 
+var revokeSerials []string
+var revokeKeyIDs []string
+var revokeSubject string
+var sshRevokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revoke issued SSH certificates by serial, key ID or subject",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filter := krl.Filter{
+			KeyIDs:  revokeKeyIDs,
+			Subject: revokeSubject,
+		}
+		for _, s := range revokeSerials {
+			serial, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid serial %s: %w", s, err)
+			}
+			filter.Serials = append(filter.Serials, serial)
+		}
+		if len(filter.Serials) == 0 && len(filter.KeyIDs) == 0 && filter.Subject == "" {
+			return fmt.Errorf("one of --serial, --key-id or --subject is required")
+		}
+
+		store, err := sshStore()
+		if err != nil {
+			return err
+		}
+		revoked, err := store.Revoke(filter)
+		if err != nil {
+			return err
+		}
+
+		return models.JSONEncoder(os.Stdout).Encode(revoked)
+	},
+}
+
+var sshListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the unexpired issued SSH certificates",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := sshStore()
+		if err != nil {
+			return err
+		}
+		records, err := store.Records()
+		if err != nil {
+			return err
+		}
+
+		return models.JSONEncoder(os.Stdout).Encode(records)
+	},
+}
+
+func sshStore() (*krl.Store, error) {
+	config, err := models.ReadConfiguration(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if config.SSHStore == "" {
+		return nil, fmt.Errorf("ssh_store is not configured")
+	}
+	return krl.NewStore(config.SSHStore), nil
+}
+
 func main() {
 	log.Logger = zerolog.New(os.Stdout).With().Timestamp().Logger()
 
@@ -127,6 +199,18 @@ func main() {
 	testVariablesCmd.Flags().StringVar(&testClaims, "claims", "{}", "Claims to use for the test")
 	testVariablesCmd.Flags().StringVar(&testParams, "params", "{}", "Params to use for the test")
 
+	sshCmd := &cobra.Command{
+		Use:   "ssh",
+		Short: "Manage issued SSH certificates",
+	}
+	rootCmd.AddCommand(sshCmd)
+	sshCmd.AddCommand(sshRevokeCmd)
+	sshCmd.AddCommand(sshListCmd)
+
+	sshRevokeCmd.Flags().StringSliceVar(&revokeSerials, "serial", nil, "Serial of the certificate to revoke")
+	sshRevokeCmd.Flags().StringSliceVar(&revokeKeyIDs, "key-id", nil, "Key ID of the certificates to revoke")
+	sshRevokeCmd.Flags().StringVar(&revokeSubject, "subject", "", "Revoke all certificates issued to the token subject")
+
 	rootCmd.PersistentFlags().StringVarP(&configPath,
 		"config", "c", "config.yaml",
 		"Path to the configuration file",
@@ -3,10 +3,12 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/exec"
 	"strings"
+	"time"
 
 	"al.essio.dev/pkg/shellescape"
 	"github.com/ezoidc/ezoidc/pkg/client"
@@ -131,6 +133,59 @@ var variablesExecCmd = &cobra.Command{
 	},
 }
 
+var variablesWriteCmd = &cobra.Command{
+	Use:   "write NAME",
+	Short: "Write the value of a variable read from stdin",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		value, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+
+		return client.NewAPIClient(http.DefaultClient, state.host).
+			WriteVariable(cmd.Context(), &models.WriteVariableRequest{
+				Token:  state.token,
+				Name:   args[0],
+				Value:  string(value),
+				Params: state.params,
+			})
+	},
+}
+
+var variablesKubeCredentialCmd = &cobra.Command{
+	Use:   "kube-credential NAME",
+	Short: "Print the token of a variable as a Kubernetes ExecCredential",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		variablesResponse, err := client.NewAPIClient(http.DefaultClient, state.host).
+			GetVariables(cmd.Context(), &models.VariablesRequest{
+				Token:  state.token,
+				Params: state.params,
+			})
+		if err != nil {
+			return err
+		}
+
+		for _, value := range variablesResponse.Variables {
+			if value.Name != args[0] {
+				continue
+			}
+
+			status := map[string]any{"token": value.Value.String}
+			if expiry, err := expiration(value.Value.String); err == nil {
+				status["expirationTimestamp"] = expiry.UTC().Format(time.RFC3339)
+			}
+			return models.JSONEncoder(os.Stdout).Encode(map[string]any{
+				"apiVersion": "client.authentication.k8s.io/v1",
+				"kind":       "ExecCredential",
+				"status":     status,
+			})
+		}
+		return fmt.Errorf("variable not found: %s", args[0])
+	},
+}
+
 func main() {
 	log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger().Level(zerolog.InfoLevel)
 	rootCmd := &cobra.Command{
@@ -143,6 +198,8 @@ func main() {
 	variablesCmd.AddCommand(variablesJsonCmd)
 	variablesCmd.AddCommand(variablesEnvCmd)
 	variablesCmd.AddCommand(variablesExecCmd)
+	variablesCmd.AddCommand(variablesWriteCmd)
+	variablesCmd.AddCommand(variablesKubeCredentialCmd)
 
 	variablesExecCmd.Flags().String("cwd", "", "Execute the command in the given directory")
 
@@ -187,6 +244,25 @@ func audience(token string) (string, error) {
 	return claims.Audience[0], nil
 }
 
+func expiration(token string) (time.Time, error) {
+	j, err := jwt.ParseSigned(token, allAlgorithms)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var claims jwt.Claims
+	err = j.UnsafeClaimsWithoutVerification(&claims)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if claims.Expiry == nil {
+		return time.Time{}, fmt.Errorf("no expiration")
+	}
+
+	return claims.Expiry.Time(), nil
+}
+
 func (s *State) prepare() error {
 	if s.tokenPath != "" {
 		token, err := os.ReadFile(s.tokenPath)
@@ -0,0 +1,18 @@
+// Package audit records security-relevant actions, such as variable writes
+// and issued credentials, in the server logs.
+package audit
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Start an audit log entry for the given action, tagged with the request ID
+func Log(ctx context.Context, action string) *zerolog.Event {
+	return log.Info().
+		Bool("audit", true).
+		Str("action", action).
+		Any("request_id", ctx.Value("request_id"))
+}
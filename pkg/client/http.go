@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/ezoidc/ezoidc/pkg/models"
@@ -54,3 +55,28 @@ func (c *APIClient) GetVariables(ctx context.Context, r *models.VariablesRequest
 	}
 	return &variablesResponse, nil
 }
+
+func (c *APIClient) WriteVariable(ctx context.Context, r *models.WriteVariableRequest) error {
+	body, _ := json.Marshal(r)
+	req, err := http.NewRequestWithContext(ctx, "PUT", c.BaseURL+"/ezoidc/1.0/variables/"+url.PathEscape(r.Name), strings.NewReader(string(body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+r.Token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		var body models.ErrorResponse
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		if err != nil {
+			return err
+		}
+
+		return fmt.Errorf("unexpected status code: %d: %s\n%s", resp.StatusCode, body.Reason, body.Error)
+	}
+	return nil
+}
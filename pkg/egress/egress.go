@@ -0,0 +1,146 @@
+// Package egress restricts the destinations of the HTTP requests sent by
+// policies, through http.send and the builtins calling external APIs.
+package egress
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ezoidc/ezoidc/pkg/audit"
+	"github.com/ezoidc/ezoidc/pkg/models"
+)
+
+var defaultPorts = map[string]string{"http": "80", "https": "443"}
+
+// Allowlist of egress destinations, a nil allowlist allows every destination
+type Allowlist struct {
+	rules []rule
+}
+
+type rule struct {
+	host    string
+	port    string
+	schemes map[string]bool
+}
+
+// Error returned for the requests to a destination that is not allowed
+type DeniedError struct {
+	URL string
+}
+
+func (e *DeniedError) Error() string {
+	return "egress denied: " + e.URL
+}
+
+// Create the allowlist of the configured rules, returns nil when unset
+func New(rules []models.EgressRule) (*Allowlist, error) {
+	if rules == nil {
+		return nil, nil
+	}
+
+	a := &Allowlist{rules: []rule{}}
+	for i, r := range rules {
+		host, port := strings.ToLower(r.Host), ""
+		if h, p, err := net.SplitHostPort(host); err == nil {
+			host, port = h, p
+		}
+		pattern := strings.TrimPrefix(host, "*.")
+		if host != "*" && (pattern == "" || strings.Contains(pattern, "*")) {
+			return nil, fmt.Errorf("egress rule %d: invalid host: %q", i, r.Host)
+		}
+
+		schemes := map[string]bool{}
+		for _, s := range r.Schemes {
+			s = strings.ToLower(s)
+			if _, ok := defaultPorts[s]; !ok {
+				return nil, fmt.Errorf("egress rule %d: unsupported scheme: %q", i, s)
+			}
+			schemes[s] = true
+		}
+		if len(schemes) == 0 {
+			schemes["https"] = true
+		}
+
+		a.rules = append(a.rules, rule{host: host, port: port, schemes: schemes})
+	}
+	return a, nil
+}
+
+// Check whether a URL is an allowed destination
+func (a *Allowlist) Allowed(u *url.URL) bool {
+	if a == nil {
+		return true
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = defaultPorts[scheme]
+	}
+
+	for _, r := range a.rules {
+		if !r.schemes[scheme] || !r.matchHost(host) {
+			continue
+		}
+		if r.port == "*" || r.port == port || (r.port == "" && port == defaultPorts[scheme]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) matchHost(host string) bool {
+	switch {
+	case r.host == "*":
+		return true
+	case strings.HasPrefix(r.host, "*."):
+		return strings.HasSuffix(host, r.host[1:]) && len(host) > len(r.host)-1
+	default:
+		return host == r.host
+	}
+}
+
+// Wrap a transport to deny the requests to destinations that are not allowed,
+// logging them with the policy location that sent them
+func (a *Allowlist) RoundTripper(base http.RoundTripper, location string) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if a == nil {
+		return base
+	}
+	return &roundTripper{allowlist: a, base: base, location: location}
+}
+
+type roundTripper struct {
+	allowlist *Allowlist
+	base      http.RoundTripper
+	location  string
+}
+
+func (t *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.allowlist.Check(req.Context(), req.Method, req.URL, t.location); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
+
+// Deny a request to a destination that is not allowed, logging it with the
+// policy location that sent it
+func (a *Allowlist) Check(ctx context.Context, method string, u *url.URL, location string) error {
+	if a.Allowed(u) {
+		return nil
+	}
+	target := u.Scheme + "://" + u.Host + u.Path
+	audit.Log(ctx, "egress.denied").
+		Str("location", location).
+		Str("method", method).
+		Str("url", target).
+		Msg("denied policy egress")
+	return &DeniedError{URL: target}
+}
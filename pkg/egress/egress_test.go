@@ -0,0 +1,98 @@
+package egress
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ezoidc/ezoidc/pkg/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowed(t *testing.T) {
+	allowlist, err := New([]models.EgressRule{
+		{Host: "api.github.com"},
+		{Host: "*.amazonaws.com"},
+		{Host: "vault.internal:8200", Schemes: []string{"https", "HTTP"}},
+		{Host: "127.0.0.1:*", Schemes: []string{"http"}},
+	})
+	assert.NoError(t, err)
+
+	cases := map[string]bool{
+		"https://api.github.com/app":                  true,
+		"https://API.GitHub.com:443/app":              true,
+		"http://api.github.com/app":                   false,
+		"https://api.github.com:8443/app":             false,
+		"https://api.github.com.evil.com/":            false,
+		"https://sts.amazonaws.com/":                  true,
+		"https://s3.us-east-1.amazonaws.com/":         true,
+		"https://amazonaws.com/":                      false,
+		"https://evilamazonaws.com/":                  false,
+		"http://vault.internal:8200/v1/secret":        true,
+		"https://vault.internal:8200/v1/secret":       true,
+		"https://vault.internal/v1/secret":            false,
+		"http://127.0.0.1:34567/":                     true,
+		"https://127.0.0.1:34567/":                    false,
+		"ftp://api.github.com/":                       false,
+		"https://metadata.google.internal/":           false,
+		"http://169.254.169.254/latest/meta-data/iam": false,
+	}
+	for raw, expected := range cases {
+		u, err := url.Parse(raw)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, allowlist.Allowed(u), raw)
+	}
+
+	// unset allows everything, and an empty list nothing
+	allowlist, err = New(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, allowlist)
+	assert.True(t, allowlist.Allowed(&url.URL{Scheme: "https", Host: "example.com"}))
+
+	allowlist, err = New([]models.EgressRule{})
+	assert.NoError(t, err)
+	assert.False(t, allowlist.Allowed(&url.URL{Scheme: "https", Host: "example.com"}))
+
+	allowlist, err = New([]models.EgressRule{{Host: "*"}})
+	assert.NoError(t, err)
+	assert.True(t, allowlist.Allowed(&url.URL{Scheme: "https", Host: "example.com"}))
+	assert.False(t, allowlist.Allowed(&url.URL{Scheme: "http", Host: "example.com"}))
+}
+
+func TestNewInvalid(t *testing.T) {
+	for _, rule := range []models.EgressRule{
+		{Host: ""},
+		{Host: "*."},
+		{Host: "api.*.com"},
+		{Host: "*example.com"},
+		{Host: "example.com", Schemes: []string{"ftp"}},
+	} {
+		_, err := New([]models.EgressRule{rule})
+		assert.Error(t, err, rule)
+	}
+}
+
+func TestRoundTripper(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	allowlist, err := New([]models.EgressRule{{Host: "127.0.0.1:*", Schemes: []string{"http"}}})
+	assert.NoError(t, err)
+	client := &http.Client{Transport: allowlist.RoundTripper(nil, "policy.rego:1")}
+
+	resp, err := client.Get(server.URL)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	}
+
+	_, err = client.Get("https://example.com/path?secret=1")
+	var denied *DeniedError
+	if assert.True(t, errors.As(err, &denied)) {
+		assert.Equal(t, "https://example.com/path", denied.URL)
+	}
+}
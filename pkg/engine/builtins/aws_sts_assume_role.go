@@ -0,0 +1,224 @@
+package builtins
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	ststypes "github.com/aws/aws-sdk-go-v2/service/sts/types"
+	"github.com/ezoidc/ezoidc/pkg/audit"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/topdown"
+	"github.com/open-policy-agent/opa/v1/topdown/builtins"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+var awsSTSAssumeRole = &rego.Function{
+	Name: "aws_sts_assume_role",
+	Decl: types.NewFunction(
+		types.Args(types.NewObject(
+			[]*types.StaticProperty{
+				types.NewStaticProperty("role_arn", types.S),
+			},
+			types.NewDynamicProperty(types.S, types.A),
+		)),
+		types.NewObject(
+			[]*types.StaticProperty{
+				types.NewStaticProperty("access_key_id", types.S),
+				types.NewStaticProperty("secret_access_key", types.S),
+				types.NewStaticProperty("session_token", types.S),
+				types.NewStaticProperty("expiration", types.S),
+			},
+			nil,
+		),
+	),
+}
+
+// Credentials are reused until this long before they expire
+const awsSTSRefreshMargin = 5 * time.Minute
+
+// Credentials by role, session name, tags, session policy and duration
+var awsSTSCache = newCredentialCache()
+
+type awsSTSAssumeRoleOptions struct {
+	RoleARN     string            `json:"role_arn"`
+	SessionName string            `json:"session_name"`
+	Tags        map[string]string `json:"tags"`
+	Policy      string            `json:"policy"`
+	Duration    time.Duration     `json:"duration"`
+	ExternalID  string            `json:"external_id"`
+	Region      string            `json:"region"`
+	Endpoint    string            `json:"endpoint"`
+}
+
+func builtinAWSSTSAssumeRole(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+	obj, err := builtins.ObjectOperand(op.Value, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	options := awsSTSAssumeRoleOptions{Duration: time.Hour}
+	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
+		key, err := builtins.StringOperand(keyTerm.Value, 1)
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "role_arn":
+			options.RoleARN, err = argString(key, valueTerm)
+		case "session_name":
+			options.SessionName, err = argString(key, valueTerm)
+		case "tags":
+			options.Tags, err = argStringMap(key, valueTerm)
+		case "policy":
+			// either a JSON document or an object encoded as one
+			if s, ok := valueTerm.Value.(ast.String); ok {
+				options.Policy = string(s)
+				break
+			}
+			if _, ok := valueTerm.Value.(ast.Object); !ok {
+				return argError(string(key), valueTerm, "string or object")
+			}
+			var policy any
+			policy, err = ast.JSON(valueTerm.Value)
+			if err == nil {
+				var b []byte
+				b, err = json.Marshal(policy)
+				options.Policy = string(b)
+			}
+		case "duration":
+			var v string
+			v, err = argString(key, valueTerm)
+			if err != nil {
+				return err
+			}
+			options.Duration, err = time.ParseDuration(v)
+			if err != nil || options.Duration < 15*time.Minute || options.Duration > 12*time.Hour {
+				return builtins.NewOperandErr(1, "argument `duration` must be a duration between 15m and 12h")
+			}
+		case "external_id":
+			options.ExternalID, err = argString(key, valueTerm)
+		case "region":
+			options.Region, err = argString(key, valueTerm)
+		case "endpoint":
+			options.Endpoint, err = argString(key, valueTerm)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if options.RoleARN == "" {
+		return nil, builtins.NewOperandErr(1, "argument `role_arn` must not be empty")
+	}
+
+	if options.SessionName == "" {
+		sub, _ := claimsFrom(bctx.Context)["sub"].(string)
+		options.SessionName = sub
+	}
+	options.SessionName = awsSessionName(options.SessionName)
+
+	key, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	cacheKey := hex.EncodeToString(sum[:])
+	if value, expires, ok := awsSTSCache.lookup(cacheKey); ok {
+		resultExpires(bctx.Context, expires)
+		return value.(*ast.Term), nil
+	}
+
+	cfg, err := config.LoadDefaultConfig(bctx.Context)
+	if err != nil {
+		return nil, err
+	}
+	client := sts.NewFromConfig(cfg, func(o *sts.Options) {
+		// keep the SDK client, only wrapping its transport when the requests are restricted
+		if restricted(bctx) {
+			var base http.RoundTripper = http.DefaultTransport
+			if c, ok := cfg.HTTPClient.(*awshttp.BuildableClient); ok {
+				base = c.GetTransport()
+			}
+			o.HTTPClient = &http.Client{Transport: policyTransport(bctx, base)}
+		}
+		if options.Region != "" {
+			o.Region = options.Region
+		}
+		if options.Endpoint != "" {
+			o.BaseEndpoint = aws.String(options.Endpoint)
+		}
+	})
+
+	input := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(options.RoleARN),
+		RoleSessionName: aws.String(options.SessionName),
+		DurationSeconds: aws.Int32(int32(options.Duration.Seconds())),
+	}
+	if options.Policy != "" {
+		input.Policy = aws.String(options.Policy)
+	}
+	if options.ExternalID != "" {
+		input.ExternalId = aws.String(options.ExternalID)
+	}
+	for k, v := range options.Tags {
+		input.Tags = append(input.Tags, ststypes.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+
+	resp, err := client.AssumeRole(bctx.Context, input)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Credentials == nil {
+		return nil, builtins.NewOperandErr(1, "no credentials returned by sts")
+	}
+
+	expiration := aws.ToTime(resp.Credentials.Expiration)
+	audit.Log(bctx.Context, "aws.sts.assume_role").
+		Str("role_arn", options.RoleARN).
+		Str("session_name", options.SessionName).
+		Str("access_key_id", aws.ToString(resp.Credentials.AccessKeyId)).
+		Time("expiration", expiration).
+		Msg("assumed aws role")
+
+	value := ast.ObjectTerm(
+		ast.Item(ast.StringTerm("access_key_id"), ast.StringTerm(aws.ToString(resp.Credentials.AccessKeyId))),
+		ast.Item(ast.StringTerm("secret_access_key"), ast.StringTerm(aws.ToString(resp.Credentials.SecretAccessKey))),
+		ast.Item(ast.StringTerm("session_token"), ast.StringTerm(aws.ToString(resp.Credentials.SessionToken))),
+		ast.Item(ast.StringTerm("expiration"), ast.StringTerm(expiration.UTC().Format(time.RFC3339))),
+	)
+	awsSTSCache.set(cacheKey, value, expiration.Add(-awsSTSRefreshMargin))
+	resultExpires(bctx.Context, expiration.Add(-awsSTSRefreshMargin))
+
+	return value, nil
+}
+
+// Replace characters not allowed in role session names, which are limited to 64 characters
+func awsSessionName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune("_+=,.@-", r):
+			return r
+		}
+		return '-'
+	}, name)
+	if len(name) < 2 {
+		name = "ezoidc"
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
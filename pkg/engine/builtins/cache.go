@@ -0,0 +1,77 @@
+package builtins
+
+import (
+	"sync"
+	"time"
+)
+
+// In-memory cache of builtin results, such as short-lived credentials
+type ttlCache struct {
+	mu      sync.Mutex
+	entries map[string]ttlCacheEntry
+	// Maximum number of entries, unbounded when zero
+	limit int
+}
+
+type ttlCacheEntry struct {
+	value   any
+	expires time.Time
+}
+
+// Maximum number of credentials cached by a builtin
+const credentialCacheMaxEntries = 1000
+
+func newTTLCache() *ttlCache {
+	return &ttlCache{entries: map[string]ttlCacheEntry{}}
+}
+
+// Cache of credentials keyed by policy arguments, which may differ for every
+// caller, bounded so that it does not grow until the entries expire
+func newCredentialCache() *ttlCache {
+	cache := newTTLCache()
+	cache.limit = credentialCacheMaxEntries
+	return cache
+}
+
+func (c *ttlCache) get(key string) (any, bool) {
+	value, _, ok := c.lookup(key)
+	return value, ok
+}
+
+// Unexpired value of the key and when it expires
+func (c *ttlCache) lookup(key string) (any, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !time.Now().Before(entry.expires) {
+		return nil, time.Time{}, false
+	}
+	return entry.value, entry.expires, true
+}
+
+func (c *ttlCache) set(key string, value any, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+
+	// make room by evicting the entries closest to expiring
+	if _, ok := c.entries[key]; !ok && c.limit > 0 {
+		for len(c.entries) >= c.limit {
+			var oldest string
+			for k, entry := range c.entries {
+				if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+					oldest = k
+				}
+			}
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = ttlCacheEntry{value: value, expires: expires}
+}
@@ -0,0 +1,119 @@
+package builtins
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ezoidc/ezoidc/pkg/models"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/topdown"
+)
+
+// HTTP client of the builtins calling external APIs
+func httpClient(bctx topdown.BuiltinContext) *http.Client {
+	transport := policyTransport(bctx, models.HTTPClient.Transport)
+	if transport == models.HTTPClient.Transport {
+		return models.HTTPClient
+	}
+	return &http.Client{
+		Timeout:   models.HTTPClient.Timeout,
+		Transport: transport,
+	}
+}
+
+// Whether the requests of the policy are restricted by an egress allowlist or evaluation limits
+func restricted(bctx topdown.BuiltinContext) bool {
+	return environment(bctx.Context).Egress != nil || limitsFrom(bctx.Context) != nil
+}
+
+// Restrict the requests of the policy to the egress allowlist and the evaluation limits
+func policyTransport(bctx topdown.BuiltinContext, base http.RoundTripper) http.RoundTripper {
+	transport := base
+	if allowlist := environment(bctx.Context).Egress; allowlist != nil {
+		transport = allowlist.RoundTripper(transport, bctx.Location.String())
+	}
+	if limits := limitsFrom(bctx.Context); limits != nil {
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		transport = &limitsRoundTripper{base: transport, limits: limits}
+	}
+	return transport
+}
+
+// Apply the egress allowlist and evaluation limits to http.send, including redirects.
+// Exceeding a limit halts the evaluation, even when `raise_error` is false.
+func wrapHTTPSend(httpSend topdown.BuiltinFunc) topdown.BuiltinFunc {
+	return func(bctx topdown.BuiltinContext, operands []*ast.Term, iter func(*ast.Term) error) error {
+		if !restricted(bctx) {
+			return httpSend(bctx, operands, iter)
+		}
+		limits := limitsFrom(bctx.Context)
+
+		customize := bctx.RoundTripper
+		bctx.RoundTripper = func(transport *http.Transport) http.RoundTripper {
+			var base http.RoundTripper
+			if customize != nil {
+				base = customize(transport)
+			} else if transport != nil {
+				base = transport
+			}
+			return policyTransport(bctx, base)
+		}
+		err := checkSendURL(bctx, operands)
+		if err == nil {
+			err = httpSend(bctx, operands, iter)
+		}
+		if limits == nil {
+			return err
+		}
+		if _, ok := err.(topdown.Halt); ok {
+			return err
+		}
+
+		var exceeded *models.LimitError
+		if err != nil {
+			exceeded = limits.builtinError()
+		} else {
+			exceeded = LimitExceeded(bctx.Context)
+		}
+		if exceeded != nil {
+			return topdown.Halt{Err: exceeded}
+		}
+		return err
+	}
+}
+
+// Check the URL of http.send against the egress allowlist before sending. OPA
+// dials the socket of unix:// URLs itself, with a transport ignoring the host
+// of the request, so these never reach the allowlist of the round tripper.
+func checkSendURL(bctx topdown.BuiltinContext, operands []*ast.Term) error {
+	allowlist := environment(bctx.Context).Egress
+	if allowlist == nil || len(operands) == 0 {
+		return nil
+	}
+	obj, ok := operands[0].Value.(ast.Object)
+	if !ok {
+		return nil
+	}
+	term := obj.Get(ast.StringTerm("url"))
+	if term == nil {
+		return nil
+	}
+	rawURL, ok := term.Value.(ast.String)
+	if !ok {
+		return nil
+	}
+	u, err := url.Parse(string(rawURL))
+	if err != nil {
+		return nil
+	}
+	method := ""
+	if term := obj.Get(ast.StringTerm("method")); term != nil {
+		if m, ok := term.Value.(ast.String); ok {
+			method = strings.ToUpper(string(m))
+		}
+	}
+	return allowlist.Check(bctx.Context, method, u, bctx.Location.String())
+}
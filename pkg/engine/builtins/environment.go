@@ -0,0 +1,51 @@
+package builtins
+
+import (
+	"context"
+
+	"github.com/ezoidc/ezoidc/pkg/egress"
+	"github.com/ezoidc/ezoidc/pkg/krl"
+	"github.com/ezoidc/ezoidc/pkg/signing"
+)
+
+// State of the builtins built by an engine when compiling. It is never
+// modified afterwards and is carried by the evaluation context, so that
+// concurrent evaluations and engines do not share it.
+type Environment struct {
+	// Keys signing the tokens minted by the policy, minting fails when nil
+	SigningKeys *signing.KeySet
+	// Records of the issued SSH certificates, not recorded when nil
+	SSHCertificateStore *krl.Store
+	// Destinations that the policy may send HTTP requests to, unrestricted when nil
+	Egress *egress.Allowlist
+	// Results of builtins called with the `cache` option
+	ResultCache *ResultCache
+}
+
+type environmentKey struct{}
+
+// Evaluate the builtins with env
+func WithEnvironment(ctx context.Context, env *Environment) context.Context {
+	return context.WithValue(ctx, environmentKey{}, env)
+}
+
+// Environment of the evaluation running with ctx, empty if none
+func environment(ctx context.Context) *Environment {
+	if env, ok := ctx.Value(environmentKey{}).(*Environment); ok && env != nil {
+		return env
+	}
+	return &Environment{}
+}
+
+type claimsKey struct{}
+
+// Evaluate the builtins on behalf of the caller authenticated with claims
+func WithClaims(ctx context.Context, claims map[string]any) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// Validated claims of the caller of the evaluation running with ctx, nil if none
+func claimsFrom(ctx context.Context) map[string]any {
+	claims, _ := ctx.Value(claimsKey{}).(map[string]any)
+	return claims
+}
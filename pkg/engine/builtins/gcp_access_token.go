@@ -0,0 +1,303 @@
+package builtins
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ezoidc/ezoidc/pkg/audit"
+	"github.com/ezoidc/ezoidc/pkg/signing"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/topdown"
+	"github.com/open-policy-agent/opa/v1/topdown/builtins"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+var gcpAccessToken = &rego.Function{
+	Name: "gcp_access_token",
+	Decl: types.NewFunction(
+		types.Args(types.NewObject(
+			[]*types.StaticProperty{
+				types.NewStaticProperty("service_account", types.S),
+			},
+			types.NewDynamicProperty(types.S, types.A),
+		)),
+		types.NewObject(
+			[]*types.StaticProperty{
+				types.NewStaticProperty("access_token", types.S),
+				types.NewStaticProperty("expiration", types.S),
+			},
+			nil,
+		),
+	),
+}
+
+const (
+	gcpDefaultScope           = "https://www.googleapis.com/auth/cloud-platform"
+	gcpDefaultSTSEndpoint     = "https://sts.googleapis.com/v1/token"
+	gcpDefaultIAMCredEndpoint = "https://iamcredentials.googleapis.com"
+	gcpRefreshMargin          = 5 * time.Minute
+)
+
+// Access tokens by source credential, service account, scopes, delegates and lifetime
+var gcpCache = newCredentialCache()
+
+type gcpAccessTokenOptions struct {
+	ServiceAccount string        `json:"service_account"`
+	Scopes         []string      `json:"scopes"`
+	Delegates      []string      `json:"delegates"`
+	Lifetime       time.Duration `json:"lifetime"`
+	// Service account key used to call the IAM Credentials API
+	Credentials string `json:"credentials"`
+	// JWT exchanged through workload identity federation
+	SubjectToken string `json:"subject_token"`
+	// Workload identity provider, //iam.googleapis.com/projects/.../providers/...
+	Audience               string `json:"audience"`
+	STSEndpoint            string `json:"sts_endpoint"`
+	IAMCredentialsEndpoint string `json:"iam_credentials_endpoint"`
+}
+
+type gcpServiceAccountKey struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+func builtinGCPAccessToken(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+	obj, err := builtins.ObjectOperand(op.Value, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	options := gcpAccessTokenOptions{
+		Scopes:                 []string{gcpDefaultScope},
+		Lifetime:               time.Hour,
+		STSEndpoint:            gcpDefaultSTSEndpoint,
+		IAMCredentialsEndpoint: gcpDefaultIAMCredEndpoint,
+	}
+	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
+		key, err := builtins.StringOperand(keyTerm.Value, 1)
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "service_account":
+			options.ServiceAccount, err = argString(key, valueTerm)
+		case "scopes":
+			options.Scopes, err = argStringArray(key, valueTerm)
+		case "delegates":
+			options.Delegates, err = argStringArray(key, valueTerm)
+		case "lifetime":
+			var v string
+			v, err = argString(key, valueTerm)
+			if err != nil {
+				return err
+			}
+			options.Lifetime, err = time.ParseDuration(v)
+			if err != nil || options.Lifetime <= 0 || options.Lifetime > 12*time.Hour {
+				return builtins.NewOperandErr(1, "argument `lifetime` must be a duration between 1s and 12h")
+			}
+		case "credentials":
+			options.Credentials, err = argString(key, valueTerm)
+		case "subject_token":
+			options.SubjectToken, err = argString(key, valueTerm)
+		case "audience":
+			options.Audience, err = argString(key, valueTerm)
+		case "sts_endpoint":
+			options.STSEndpoint, err = argString(key, valueTerm)
+		case "iam_credentials_endpoint":
+			options.IAMCredentialsEndpoint, err = argString(key, valueTerm)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if options.ServiceAccount == "" {
+		return nil, builtins.NewOperandErr(1, "argument `service_account` must not be empty")
+	}
+	if (options.Credentials == "") == (options.SubjectToken == "") {
+		return nil, builtins.NewOperandErr(1, "exactly one of argument `credentials` or `subject_token` must be set")
+	}
+	if options.SubjectToken != "" && options.Audience == "" {
+		return nil, builtins.NewOperandErr(1, "argument `audience` must be set with `subject_token`")
+	}
+
+	key, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	cacheKey := hex.EncodeToString(sum[:])
+	if value, expires, ok := gcpCache.lookup(cacheKey); ok {
+		resultExpires(bctx.Context, expires)
+		return value.(*ast.Term), nil
+	}
+
+	var sourceToken string
+	if options.SubjectToken != "" {
+		sourceToken, err = gcpExchangeSubjectToken(bctx, &options)
+	} else {
+		sourceToken, err = gcpServiceAccountToken(bctx, options.Credentials)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, expiration, err := gcpGenerateAccessToken(bctx, &options, sourceToken)
+	if err != nil {
+		return nil, err
+	}
+
+	audit.Log(bctx.Context, "gcp.access_token").
+		Str("service_account", options.ServiceAccount).
+		Strs("scopes", options.Scopes).
+		Strs("delegates", options.Delegates).
+		Time("expiration", expiration).
+		Msg("generated gcp access token")
+
+	value := ast.ObjectTerm(
+		ast.Item(ast.StringTerm("access_token"), ast.StringTerm(accessToken)),
+		ast.Item(ast.StringTerm("expiration"), ast.StringTerm(expiration.UTC().Format(time.RFC3339))),
+	)
+	gcpCache.set(cacheKey, value, expiration.Add(-gcpRefreshMargin))
+	resultExpires(bctx.Context, expiration.Add(-gcpRefreshMargin))
+
+	return value, nil
+}
+
+// Exchange a JWT for a federated access token using workload identity federation
+func gcpExchangeSubjectToken(bctx topdown.BuiltinContext, options *gcpAccessTokenOptions) (string, error) {
+	body, err := json.Marshal(map[string]string{
+		"grantType":          "urn:ietf:params:oauth:grant-type:token-exchange",
+		"audience":           options.Audience,
+		"scope":              gcpDefaultScope,
+		"requestedTokenType": "urn:ietf:params:oauth:token-type:access_token",
+		"subjectToken":       options.SubjectToken,
+		"subjectTokenType":   "urn:ietf:params:oauth:token-type:jwt",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = gcpDo(bctx, options.STSEndpoint, "application/json", bytes.NewReader(body), "", &resp)
+	if err != nil {
+		return "", fmt.Errorf("sts token exchange: %w", err)
+	}
+	return resp.AccessToken, nil
+}
+
+// Get an access token of the service account key using the JWT bearer grant
+func gcpServiceAccountToken(bctx topdown.BuiltinContext, credentials string) (string, error) {
+	var key gcpServiceAccountKey
+	if err := json.Unmarshal([]byte(credentials), &key); err != nil {
+		return "", builtins.NewOperandErr(1, "invalid `credentials`: %v", err)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	privateKey, err := signing.ParsePrivateKey(key.PrivateKey)
+	if err != nil {
+		return "", builtins.NewOperandErr(1, "invalid `credentials` private key: %v", err)
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: privateKey},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", key.PrivateKeyID),
+	)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	assertion, err := jwt.Signed(signer).Claims(map[string]any{
+		"iss":   key.ClientEmail,
+		"scope": gcpDefaultScope,
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).Serialize()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	var resp struct {
+		AccessToken string `json:"access_token"`
+	}
+	err = gcpDo(bctx, key.TokenURI, "application/x-www-form-urlencoded", strings.NewReader(form.Encode()), "", &resp)
+	if err != nil {
+		return "", fmt.Errorf("service account token: %w", err)
+	}
+	return resp.AccessToken, nil
+}
+
+// Impersonate the service account with the IAM Credentials API
+func gcpGenerateAccessToken(bctx topdown.BuiltinContext, options *gcpAccessTokenOptions, sourceToken string) (string, time.Time, error) {
+	delegates := make([]string, 0, len(options.Delegates))
+	for _, d := range options.Delegates {
+		delegates = append(delegates, "projects/-/serviceAccounts/"+d)
+	}
+	body, err := json.Marshal(map[string]any{
+		"scope":     options.Scopes,
+		"delegates": delegates,
+		"lifetime":  fmt.Sprintf("%ds", int64(options.Lifetime.Seconds())),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/projects/-/serviceAccounts/%s:generateAccessToken",
+		strings.TrimSuffix(options.IAMCredentialsEndpoint, "/"), url.PathEscape(options.ServiceAccount))
+	var resp struct {
+		AccessToken string    `json:"accessToken"`
+		ExpireTime  time.Time `json:"expireTime"`
+	}
+	err = gcpDo(bctx, endpoint, "application/json", bytes.NewReader(body), sourceToken, &resp)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("generate access token: %w", err)
+	}
+	return resp.AccessToken, resp.ExpireTime, nil
+}
+
+func gcpDo(bctx topdown.BuiltinContext, endpoint string, contentType string, body io.Reader, token string, out any) error {
+	req, err := http.NewRequestWithContext(bctx.Context, "POST", endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := httpClient(bctx).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s returned status code %d: %s", endpoint, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
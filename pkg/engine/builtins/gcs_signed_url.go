@@ -0,0 +1,163 @@
+package builtins
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ezoidc/ezoidc/pkg/audit"
+	"github.com/ezoidc/ezoidc/pkg/signing"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/topdown"
+	"github.com/open-policy-agent/opa/v1/topdown/builtins"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+var gcsSignedURL = &rego.Function{
+	Name: "gcs_signed_url",
+	Decl: types.NewFunction(
+		types.Args(types.NewObject(
+			[]*types.StaticProperty{
+				types.NewStaticProperty("bucket", types.S),
+				types.NewStaticProperty("object", types.S),
+				types.NewStaticProperty("credentials", types.S),
+			},
+			types.NewDynamicProperty(types.S, types.A),
+		)),
+		types.S,
+	),
+}
+
+const gcsDefaultEndpoint = "https://storage.googleapis.com"
+
+// Signs a Cloud Storage V4 URL with the RSA key of a service account key file
+func builtinGCSSignedURL(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+	obj, err := builtins.ObjectOperand(op.Value, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	options := newPresignOptions()
+	var bucket, object, credentials string
+	endpoint := gcsDefaultEndpoint
+
+	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
+		key, err := builtins.StringOperand(keyTerm.Value, 1)
+		if err != nil {
+			return err
+		}
+		if ok, err := options.parse(key, valueTerm); ok {
+			return err
+		}
+
+		switch key {
+		case "bucket":
+			bucket, err = argString(key, valueTerm)
+		case "object":
+			object, err = argString(key, valueTerm)
+		case "credentials":
+			credentials, err = argString(key, valueTerm)
+		case "endpoint":
+			endpoint, err = argString(key, valueTerm)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if bucket == "" || object == "" {
+		return nil, builtins.NewOperandErr(1, "argument `bucket` and `object` must not be empty")
+	}
+	if err := options.validate("GET", "HEAD", "PUT", "DELETE"); err != nil {
+		return nil, err
+	}
+
+	var key gcpServiceAccountKey
+	if err := json.Unmarshal([]byte(credentials), &key); err != nil || key.ClientEmail == "" {
+		return nil, builtins.NewOperandErr(1, "argument `credentials` must be a service account key")
+	}
+	privateKey, err := signing.ParsePrivateKey(key.PrivateKey)
+	if err != nil {
+		return nil, builtins.NewOperandErr(1, "invalid `credentials` private key: %v", err)
+	}
+	if _, ok := privateKey.(*rsa.PrivateKey); !ok {
+		return nil, builtins.NewOperandErr(1, "invalid `credentials` private key: must be an RSA key")
+	}
+
+	base, err := url.Parse(endpoint)
+	if err != nil || base.Host == "" {
+		return nil, builtins.NewOperandErr(1, "argument `endpoint` must be a URL")
+	}
+
+	now := evalTime(bctx)
+	datetime := now.Format("20060102T150405Z")
+	scope := now.Format("20060102") + "/auto/storage/goog4_request"
+	path := uriEncode(strings.TrimSuffix(base.Path, "/")+"/"+bucket+"/"+object, false)
+
+	headers := map[string]string{"host": base.Host}
+	if options.ContentType != "" {
+		headers["content-type"] = options.ContentType
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(headers[name]))
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	query := url.Values{
+		"X-Goog-Algorithm":     {"GOOG4-RSA-SHA256"},
+		"X-Goog-Credential":    {key.ClientEmail + "/" + scope},
+		"X-Goog-Date":          {datetime},
+		"X-Goog-Expires":       {strconv.FormatInt(int64(options.Expires.Seconds()), 10)},
+		"X-Goog-SignedHeaders": {signedHeaders},
+	}
+	canonicalRequest := strings.Join([]string{
+		options.Method,
+		path,
+		canonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"GOOG4-RSA-SHA256",
+		datetime,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	digest := sha256.Sum256([]byte(stringToSign))
+	signature, err := privateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	resultExpires(bctx.Context, now.Add(options.Expires))
+	audit.Log(bctx.Context, "gcs.signed_url").
+		Str("method", options.Method).
+		Str("bucket", bucket).
+		Str("object", object).
+		Str("service_account", key.ClientEmail).
+		Time("expiration", now.Add(options.Expires)).
+		Msg("signed gcs url")
+
+	signedURL := fmt.Sprintf("%s://%s%s?%s&X-Goog-Signature=%s",
+		base.Scheme, base.Host, path, canonicalQuery(query), hex.EncodeToString(signature))
+	return ast.StringTerm(signedURL), nil
+}
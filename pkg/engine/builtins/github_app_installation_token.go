@@ -0,0 +1,246 @@
+package builtins
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ezoidc/ezoidc/pkg/audit"
+	"github.com/ezoidc/ezoidc/pkg/signing"
+	"github.com/ezoidc/ezoidc/pkg/static"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/topdown"
+	"github.com/open-policy-agent/opa/v1/topdown/builtins"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+var githubAppInstallationToken = &rego.Function{
+	Name: "github_app_installation_token",
+	Decl: types.NewFunction(
+		types.Args(types.NewObject(
+			[]*types.StaticProperty{
+				types.NewStaticProperty("app_id", types.NewAny(types.S, types.N)),
+				types.NewStaticProperty("private_key", types.S),
+				types.NewStaticProperty("installation_id", types.NewAny(types.S, types.N)),
+			},
+			types.NewDynamicProperty(types.S, types.A),
+		)),
+		types.S,
+	),
+}
+
+const (
+	githubDefaultBaseURL = "https://api.github.com"
+	githubRefreshMargin  = 5 * time.Minute
+)
+
+// Installation tokens by app, installation, repositories and permissions
+var githubCache = newCredentialCache()
+
+// Permissions of installation access tokens, see "Create an installation access token for an app"
+var githubPermissions = map[string]bool{
+	"actions": true, "administration": true, "attestations": true, "checks": true,
+	"codespaces": true, "contents": true, "custom_properties_for_organizations": true,
+	"dependabot_secrets": true, "deployments": true, "discussions": true,
+	"email_addresses": true, "environments": true, "followers": true, "git_ssh_keys": true,
+	"gpg_keys": true, "interaction_limits": true, "issues": true, "members": true,
+	"merge_queues": true, "metadata": true, "organization_administration": true,
+	"organization_announcement_banners": true, "organization_copilot_seat_management": true,
+	"organization_custom_org_roles": true, "organization_custom_properties": true,
+	"organization_custom_roles": true, "organization_events": true, "organization_hooks": true,
+	"organization_packages": true, "organization_personal_access_token_requests": true,
+	"organization_personal_access_tokens": true, "organization_plan": true,
+	"organization_projects": true, "organization_secrets": true,
+	"organization_self_hosted_runners": true, "organization_user_blocking": true,
+	"packages": true, "pages": true, "profile": true, "pull_requests": true,
+	"repository_custom_properties": true, "repository_hooks": true, "repository_projects": true,
+	"secret_scanning_alerts": true, "secrets": true, "security_events": true,
+	"single_file": true, "starring": true, "statuses": true, "team_discussions": true,
+	"vulnerability_alerts": true, "workflows": true,
+}
+
+var githubPermissionLevels = map[string]bool{"read": true, "write": true, "admin": true}
+
+type githubAppInstallationTokenOptions struct {
+	BaseURL        string `json:"base_url"`
+	AppID          string `json:"app_id"`
+	PrivateKey     string `json:"private_key"`
+	InstallationID string `json:"installation_id"`
+	githubAccessTokenRequest
+}
+
+// Body of POST /app/installations/{installation_id}/access_tokens
+type githubAccessTokenRequest struct {
+	Repositories  []string          `json:"repositories,omitempty"`
+	RepositoryIDs []int64           `json:"repository_ids,omitempty"`
+	Permissions   map[string]string `json:"permissions,omitempty"`
+}
+
+// Creates an installation access token, narrowed to the given repositories
+// and permissions. The `body` option of the former Rego function is still
+// accepted for its repositories and permissions.
+func builtinGitHubAppInstallationToken(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+	obj, err := builtins.ObjectOperand(op.Value, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	options := githubAppInstallationTokenOptions{BaseURL: githubDefaultBaseURL}
+	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
+		key, err := builtins.StringOperand(keyTerm.Value, 1)
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "app_id":
+			options.AppID, err = argID(key, valueTerm)
+		case "private_key":
+			options.PrivateKey, err = argString(key, valueTerm)
+		case "installation_id":
+			options.InstallationID, err = argPositiveID(key, valueTerm)
+		case "base_url":
+			options.BaseURL, err = argString(key, valueTerm)
+		case "repositories":
+			options.Repositories, err = argStringArray(key, valueTerm)
+		case "repository_ids":
+			options.RepositoryIDs, err = argNumberArray(key, valueTerm)
+		case "permissions":
+			options.Permissions, err = argStringMap(key, valueTerm)
+		case "body":
+			if _, ok := valueTerm.Value.(ast.Object); !ok {
+				return argError(string(key), valueTerm, "object")
+			}
+			var body any
+			body, err = ast.JSON(valueTerm.Value)
+			if err != nil {
+				return err
+			}
+			data, _ := json.Marshal(body)
+			if err := json.Unmarshal(data, &options.githubAccessTokenRequest); err != nil {
+				return builtins.NewOperandErr(1, "invalid argument `body`: %v", err)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if options.AppID == "" || options.PrivateKey == "" || options.InstallationID == "" {
+		return nil, builtins.NewOperandErr(1, "argument `app_id`, `private_key` and `installation_id` must not be empty")
+	}
+	for name, level := range options.Permissions {
+		if !githubPermissions[name] {
+			return nil, builtins.NewOperandErr(1, "argument `permissions` contains an unknown permission: %s", name)
+		}
+		if !githubPermissionLevels[level] {
+			return nil, builtins.NewOperandErr(1, "argument `permissions` must be read, write or admin, got %s: %s", name, level)
+		}
+	}
+	sort.Strings(options.Repositories)
+	sort.Slice(options.RepositoryIDs, func(i, j int) bool { return options.RepositoryIDs[i] < options.RepositoryIDs[j] })
+	options.BaseURL = strings.TrimSuffix(options.BaseURL, "/")
+
+	key, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	cacheKey := hex.EncodeToString(sum[:])
+	if value, expires, ok := githubCache.lookup(cacheKey); ok {
+		resultExpires(bctx.Context, expires)
+		return value.(*ast.Term), nil
+	}
+
+	appToken, err := githubAppJWT(&options)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(options.githubAccessTokenRequest)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := fmt.Sprintf("%s/app/installations/%s/access_tokens", options.BaseURL, options.InstallationID)
+	req, err := http.NewRequestWithContext(bctx.Context, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+appToken)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ezoidc/"+static.Version)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	resp, err := httpClient(bctx).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s returned status code %d: %s", endpoint, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("invalid installation token response: %w", err)
+	}
+	if token.Token == "" {
+		return nil, fmt.Errorf("invalid installation token response: missing token")
+	}
+
+	audit.Log(bctx.Context, "github.installation_token").
+		Str("app_id", options.AppID).
+		Str("installation_id", options.InstallationID).
+		Strs("repositories", options.Repositories).
+		Interface("permissions", options.Permissions).
+		Time("expiration", token.ExpiresAt).
+		Msg("created github installation token")
+
+	value := ast.StringTerm(token.Token)
+	githubCache.set(cacheKey, value, token.ExpiresAt.Add(-githubRefreshMargin))
+	resultExpires(bctx.Context, token.ExpiresAt.Add(-githubRefreshMargin))
+
+	return value, nil
+}
+
+// Sign the JWT authenticating as the app, backdated to allow for clock drift
+func githubAppJWT(options *githubAppInstallationTokenOptions) (string, error) {
+	privateKey, err := signing.ParsePrivateKey(options.PrivateKey)
+	if err != nil {
+		return "", builtins.NewOperandErr(1, "invalid `private_key`: %v", err)
+	}
+	if _, ok := privateKey.(*rsa.PrivateKey); !ok {
+		return "", builtins.NewOperandErr(1, "invalid `private_key`: must be an RSA key")
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.RS256, Key: privateKey},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   options.AppID,
+		IssuedAt: jwt.NewNumericDate(now.Add(-time.Minute)),
+		Expiry:   jwt.NewNumericDate(now.Add(9 * time.Minute)),
+	}).Serialize()
+}
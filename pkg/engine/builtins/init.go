@@ -2,9 +2,11 @@ package builtins
 
 import (
 	"fmt"
+	"strconv"
 
 	"github.com/open-policy-agent/opa/v1/ast"
 	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/topdown"
 	"github.com/open-policy-agent/opa/v1/topdown/builtins"
 	"github.com/rs/zerolog/log"
 )
@@ -16,32 +18,177 @@ func init() {
 			log.Warn().
 				Str("location", bctx.Location.String()).
 				Msgf("%s: %v", totpVerify.Name, err)
-			return nil, err
+			return nil, limitBuiltinError(bctx, err)
+		}
+		return ret, nil
+	})
+
+	rego.RegisterBuiltin1(totpGenerate, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+		ret, err := builtinTotpGenerate(bctx, op)
+		if err != nil {
+			log.Warn().
+				Str("location", bctx.Location.String()).
+				Msgf("%s: %v", totpGenerate.Name, err)
+			return nil, limitBuiltinError(bctx, err)
+		}
+		return ret, nil
+	})
+
+	rego.RegisterBuiltin1(hotpVerify, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+		ret, err := builtinHotpVerify(bctx, op)
+		if err != nil {
+			log.Warn().
+				Str("location", bctx.Location.String()).
+				Msgf("%s: %v", hotpVerify.Name, err)
+			return nil, limitBuiltinError(bctx, err)
+		}
+		return ret, nil
+	})
+
+	rego.RegisterBuiltin1(hotpGenerate, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+		ret, err := builtinHotpGenerate(bctx, op)
+		if err != nil {
+			log.Warn().
+				Str("location", bctx.Location.String()).
+				Msgf("%s: %v", hotpGenerate.Name, err)
+			return nil, limitBuiltinError(bctx, err)
 		}
 		return ret, nil
 	})
 
 	rego.RegisterBuiltin1(sshCert, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
-		ret, err := builtinSSHCert(bctx, op)
+		ret, err := cached(bctx, sshCert, op, builtinSSHCert)
 		if err != nil {
 			log.Warn().
 				Str("location", bctx.Location.String()).
 				Msgf("%s: %v", sshCert.Name, err)
-			return nil, err
+			return nil, limitBuiltinError(bctx, err)
 		}
 		return ret, nil
 	})
 
 	rego.RegisterBuiltin1(kubernetesServiceAccountToken, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
-		ret, err := builtinKubernetesServiceAccountToken(bctx, op)
+		ret, err := cached(bctx, kubernetesServiceAccountToken, op, builtinKubernetesServiceAccountToken)
 		if err != nil {
 			log.Warn().
 				Str("location", bctx.Location.String()).
 				Msgf("%s: %v", kubernetesServiceAccountToken.Name, err)
-			return nil, err
+			return nil, limitBuiltinError(bctx, err)
+		}
+		return ret, nil
+	})
+
+	rego.RegisterBuiltin1(awsSTSAssumeRole, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+		ret, err := cached(bctx, awsSTSAssumeRole, op, builtinAWSSTSAssumeRole)
+		if err != nil {
+			log.Warn().
+				Str("location", bctx.Location.String()).
+				Msgf("%s: %v", awsSTSAssumeRole.Name, err)
+			return nil, limitBuiltinError(bctx, err)
+		}
+		return ret, nil
+	})
+
+	rego.RegisterBuiltin1(gcpAccessToken, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+		ret, err := cached(bctx, gcpAccessToken, op, builtinGCPAccessToken)
+		if err != nil {
+			log.Warn().
+				Str("location", bctx.Location.String()).
+				Msgf("%s: %v", gcpAccessToken.Name, err)
+			return nil, limitBuiltinError(bctx, err)
+		}
+		return ret, nil
+	})
+
+	rego.RegisterBuiltin1(mintJWT, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+		ret, err := cached(bctx, mintJWT, op, builtinMintJWT)
+		if err != nil {
+			log.Warn().
+				Str("location", bctx.Location.String()).
+				Msgf("%s: %v", mintJWT.Name, err)
+			return nil, limitBuiltinError(bctx, err)
+		}
+		return ret, nil
+	})
+
+	rego.RegisterBuiltin1(x509Cert, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+		ret, err := cached(bctx, x509Cert, op, builtinX509Cert)
+		if err != nil {
+			log.Warn().
+				Str("location", bctx.Location.String()).
+				Msgf("%s: %v", x509Cert.Name, err)
+			return nil, limitBuiltinError(bctx, err)
+		}
+		return ret, nil
+	})
+
+	rego.RegisterBuiltin1(s3Presign, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+		ret, err := cached(bctx, s3Presign, op, builtinS3Presign)
+		if err != nil {
+			log.Warn().
+				Str("location", bctx.Location.String()).
+				Msgf("%s: %v", s3Presign.Name, err)
+			return nil, limitBuiltinError(bctx, err)
+		}
+		return ret, nil
+	})
+
+	rego.RegisterBuiltin1(gcsSignedURL, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+		ret, err := cached(bctx, gcsSignedURL, op, builtinGCSSignedURL)
+		if err != nil {
+			log.Warn().
+				Str("location", bctx.Location.String()).
+				Msgf("%s: %v", gcsSignedURL.Name, err)
+			return nil, limitBuiltinError(bctx, err)
+		}
+		return ret, nil
+	})
+
+	rego.RegisterBuiltin1(azureBlobSAS, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+		ret, err := cached(bctx, azureBlobSAS, op, builtinAzureBlobSAS)
+		if err != nil {
+			log.Warn().
+				Str("location", bctx.Location.String()).
+				Msgf("%s: %v", azureBlobSAS.Name, err)
+			return nil, limitBuiltinError(bctx, err)
+		}
+		return ret, nil
+	})
+
+	rego.RegisterBuiltin1(oauth2ClientCredentials, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+		ret, err := cached(bctx, oauth2ClientCredentials, op, builtinOAuth2ClientCredentials)
+		if err != nil {
+			log.Warn().
+				Str("location", bctx.Location.String()).
+				Msgf("%s: %v", oauth2ClientCredentials.Name, err)
+			return nil, limitBuiltinError(bctx, err)
+		}
+		return ret, nil
+	})
+
+	rego.RegisterBuiltin1(githubAppInstallationToken, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+		ret, err := cached(bctx, githubAppInstallationToken, op, builtinGitHubAppInstallationToken)
+		if err != nil {
+			log.Warn().
+				Str("location", bctx.Location.String()).
+				Msgf("%s: %v", githubAppInstallationToken.Name, err)
+			return nil, limitBuiltinError(bctx, err)
+		}
+		return ret, nil
+	})
+
+	rego.RegisterBuiltin1(kubeconfig, func(bctx rego.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+		ret, err := cached(bctx, kubeconfig, op, builtinKubeconfig)
+		if err != nil {
+			log.Warn().
+				Str("location", bctx.Location.String()).
+				Msgf("%s: %v", kubeconfig.Name, err)
+			return nil, limitBuiltinError(bctx, err)
 		}
 		return ret, nil
 	})
+
+	topdown.RegisterBuiltinFunc(ast.HTTPSend.Name, wrapHTTPSend(topdown.GetBuiltin(ast.HTTPSend.Name)))
 }
 
 func argError(key string, got *ast.Term, expected string) error {
@@ -108,3 +255,55 @@ func argStringMap(key ast.String, value *ast.Term) (map[string]string, error) {
 	}
 	return out, nil
 }
+
+// A numeric identifier given as a number or string
+func argID(key ast.String, value *ast.Term) (string, error) {
+	switch v := value.Value.(type) {
+	case ast.String:
+		return string(v), nil
+	case ast.Number:
+		n, ok := v.Int64()
+		if !ok {
+			return "", argError(string(key), value, "integer")
+		}
+		return strconv.FormatInt(n, 10), nil
+	}
+	return "", argError(string(key), value, "string or number")
+}
+
+// A positive integer identifier given as a number or string, safe to use in a URL path
+func argPositiveID(key ast.String, value *ast.Term) (string, error) {
+	id, err := argID(key, value)
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || n <= 0 {
+		return "", fmt.Errorf("argument `%s` must be a positive integer, got %s", key, value)
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+func argNumberArray(key ast.String, value *ast.Term) ([]int64, error) {
+	v, err := builtins.ArrayOperand(value.Value, 1)
+	if err != nil {
+		return nil, argError(string(key), value, "array")
+	}
+	out := make([]int64, 0)
+	err = v.Iter(func(elem *ast.Term) error {
+		n, ok := elem.Value.(ast.Number)
+		if !ok {
+			return fmt.Errorf("argument `%s` must be an array of numbers", key)
+		}
+		i, ok := n.Int64()
+		if !ok {
+			return fmt.Errorf("argument `%s` must be an array of integers", key)
+		}
+		out = append(out, i)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,214 @@
+package builtins
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/ezoidc/ezoidc/pkg/audit"
+	"github.com/ezoidc/ezoidc/pkg/providers"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/topdown"
+	"github.com/open-policy-agent/opa/v1/topdown/builtins"
+	"github.com/open-policy-agent/opa/v1/types"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+var kubeconfig = &rego.Function{
+	Name: "kubeconfig",
+	Decl: types.NewFunction(
+		types.Args(types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
+		types.S,
+	),
+}
+
+// API version of the ExecCredential printed by `ezoidc variables kube-credential`
+const kubeconfigExecAPIVersion = "client.authentication.k8s.io/v1"
+
+// Credential plugin calling the ezoidc CLI for the token of a variable
+type kubeconfigExecOptions struct {
+	Variable string
+	Params   map[string]string
+	Host     string
+	Command  string
+}
+
+// Generates a kubeconfig for a cluster, authenticated either with a freshly
+// minted service account token or with an exec stanza calling the ezoidc CLI.
+func builtinKubeconfig(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+	obj, err := builtins.ObjectOperand(op.Value, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	options := kubernetesTokenOptions{}
+	var server, certificateAuthority, name string
+	var exec *kubeconfigExecOptions
+
+	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
+		key, err := builtins.StringOperand(keyTerm.Value, 1)
+		if err != nil {
+			return err
+		}
+		if ok, err := options.parse(key, valueTerm); ok {
+			return err
+		}
+
+		switch key {
+		case "server":
+			server, err = argString(key, valueTerm)
+		case "certificate_authority_data":
+			certificateAuthority, err = argString(key, valueTerm)
+		case "name":
+			name, err = argString(key, valueTerm)
+		case "exec":
+			exec, err = parseKubeconfigExec(valueTerm)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" {
+		name = options.Cluster
+		if name == "" {
+			name = "ezoidc"
+		}
+	}
+
+	var insecure bool
+	if server == "" || certificateAuthority == "" {
+		restConfig, err := providers.KubernetesRESTConfigForCluster(options.Cluster)
+		if err != nil {
+			if server == "" {
+				return nil, fmt.Errorf("argument `server` is required without cluster connection: %w", err)
+			}
+		} else {
+			if server == "" {
+				server = restConfig.Host
+			}
+			if certificateAuthority == "" {
+				certificateAuthority = string(restConfig.CAData)
+				if certificateAuthority == "" && restConfig.CAFile != "" {
+					ca, err := os.ReadFile(restConfig.CAFile)
+					if err != nil {
+						return nil, err
+					}
+					certificateAuthority = string(ca)
+				}
+			}
+			insecure = restConfig.Insecure
+		}
+	}
+
+	user := clientcmdapi.NewAuthInfo()
+	if exec != nil {
+		user.Exec = exec.config()
+		if options.Namespace == "" {
+			options.Namespace = providers.KubernetesNamespaceForCluster(options.Cluster)
+		}
+	} else {
+		if err := options.validate(); err != nil {
+			return nil, err
+		}
+		user.Token, err = options.createToken(bctx.Context)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cluster := clientcmdapi.NewCluster()
+	cluster.Server = server
+	cluster.CertificateAuthorityData = []byte(certificateAuthority)
+	cluster.InsecureSkipTLSVerify = insecure && certificateAuthority == ""
+
+	kubeContext := clientcmdapi.NewContext()
+	kubeContext.Cluster = name
+	kubeContext.AuthInfo = name
+	kubeContext.Namespace = options.Namespace
+
+	config := clientcmdapi.NewConfig()
+	config.Clusters[name] = cluster
+	config.AuthInfos[name] = user
+	config.Contexts[name] = kubeContext
+	config.CurrentContext = name
+
+	out, err := clientcmd.Write(*config)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := audit.Log(bctx.Context, "kubernetes.kubeconfig").
+		Str("cluster", options.Cluster).
+		Str("server", server).
+		Str("namespace", options.Namespace)
+	if exec != nil {
+		entry = entry.Str("exec_variable", exec.Variable)
+	} else {
+		entry = entry.Str("service_account", options.ServiceAccount)
+	}
+	entry.Msg("generated kubeconfig")
+
+	return ast.StringTerm(string(out)), nil
+}
+
+func parseKubeconfigExec(value *ast.Term) (*kubeconfigExecOptions, error) {
+	obj, err := builtins.ObjectOperand(value.Value, 1)
+	if err != nil {
+		return nil, argError("exec", value, "object")
+	}
+
+	exec := &kubeconfigExecOptions{Command: "ezoidc"}
+	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
+		key, err := builtins.StringOperand(keyTerm.Value, 1)
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "variable":
+			exec.Variable, err = argString("exec.variable", valueTerm)
+		case "params":
+			exec.Params, err = argStringMap("exec.params", valueTerm)
+		case "host":
+			exec.Host, err = argString("exec.host", valueTerm)
+		case "command":
+			exec.Command, err = argString("exec.command", valueTerm)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if exec.Variable == "" || exec.Command == "" {
+		return nil, builtins.NewOperandErr(1, "argument `exec.variable` and `exec.command` must not be empty")
+	}
+	return exec, nil
+}
+
+func (e *kubeconfigExecOptions) config() *clientcmdapi.ExecConfig {
+	args := []string{"variables", "kube-credential", e.Variable}
+	if e.Host != "" {
+		args = append(args, "--host", e.Host)
+	}
+	keys := make([]string, 0, len(e.Params))
+	for k := range e.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "--param", k+"="+e.Params[k])
+	}
+
+	return &clientcmdapi.ExecConfig{
+		Command:         e.Command,
+		Args:            args,
+		APIVersion:      kubeconfigExecAPIVersion,
+		InstallHint:     "Install the ezoidc CLI: https://github.com/ezoidc/ezoidc#installation",
+		InteractiveMode: clientcmdapi.NeverExecInteractiveMode,
+	}
+}
@@ -48,11 +48,12 @@ func (c *inClusterKubernetesServiceAccountTokenClient) CreateToken(
 	if err != nil {
 		return "", err
 	}
+	resultExpires(ctx, resp.Status.ExpirationTimestamp.Time)
 	return resp.Status.Token, nil
 }
 
-func newKubernetesServiceAccountTokenClient() (kubernetesServiceAccountTokenClient, error) {
-	client, err := providers.CurrentKubernetesClient()
+func newKubernetesServiceAccountTokenClient(cluster string) (kubernetesServiceAccountTokenClient, error) {
+	client, err := providers.KubernetesClientForCluster(cluster)
 	if err != nil {
 		return nil, err
 	}
@@ -60,110 +61,116 @@ func newKubernetesServiceAccountTokenClient() (kubernetesServiceAccountTokenClie
 	return &inClusterKubernetesServiceAccountTokenClient{client: client}, nil
 }
 
-func builtinKubernetesServiceAccountToken(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
-	obj, err := builtins.ObjectOperand(op.Value, 1)
-	if err != nil {
-		return nil, err
-	}
-
-	var (
-		serviceAccount    string
-		namespace         string
-		audiences         []string
-		boundObjectKind   string
-		boundObjectName   string
-		boundObjectUID    string
-		expirationSeconds int64
-	)
-
-	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
-		key, err := builtins.StringOperand(keyTerm.Value, 1)
-		if err != nil {
-			return err
-		}
+// Options of a TokenRequest, shared by the builtins minting service account tokens
+type kubernetesTokenOptions struct {
+	ServiceAccount    string
+	Namespace         string
+	Cluster           string
+	Audiences         []string
+	BoundObjectKind   string
+	BoundObjectName   string
+	BoundObjectUID    string
+	ExpirationSeconds int64
+}
 
-		switch key {
-		case "service_account":
-			serviceAccount, err = argString(key, valueTerm)
-			if err != nil {
-				return err
-			}
-		case "namespace":
-			namespace, err = argString(key, valueTerm)
-			if err != nil {
-				return err
-			}
-		case "audiences":
-			audiences, err = argStringArray(key, valueTerm)
-			if err != nil {
-				return err
-			}
-		case "expiration_seconds":
-			expirationSeconds, err = argNumber(key, valueTerm)
-			if err != nil {
-				return err
-			}
-		case "bound_object_kind":
-			boundObjectKind, err = argString(key, valueTerm)
-			if err != nil {
-				return err
-			}
-		case "bound_object_name":
-			boundObjectName, err = argString(key, valueTerm)
-			if err != nil {
-				return err
-			}
-		case "bound_object_uid":
-			boundObjectUID, err = argString(key, valueTerm)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
+// Parse a token option, returns false when the key is not one
+func (o *kubernetesTokenOptions) parse(key ast.String, value *ast.Term) (bool, error) {
+	var err error
+	switch key {
+	case "service_account":
+		o.ServiceAccount, err = argString(key, value)
+	case "namespace":
+		o.Namespace, err = argString(key, value)
+	case "cluster":
+		o.Cluster, err = argString(key, value)
+	case "audiences":
+		o.Audiences, err = argStringArray(key, value)
+	case "expiration_seconds":
+		o.ExpirationSeconds, err = argNumber(key, value)
+	case "bound_object_kind":
+		o.BoundObjectKind, err = argString(key, value)
+	case "bound_object_name":
+		o.BoundObjectName, err = argString(key, value)
+	case "bound_object_uid":
+		o.BoundObjectUID, err = argString(key, value)
+	default:
+		return false, nil
 	}
+	return true, err
+}
 
-	if serviceAccount == "" {
-		return nil, builtins.NewOperandErr(1, "argument `service_account` must not be empty")
+// Validate the options and fill in the default namespace of the cluster
+func (o *kubernetesTokenOptions) validate() error {
+	if o.ServiceAccount == "" {
+		return builtins.NewOperandErr(1, "argument `service_account` must not be empty")
 	}
 
-	if namespace == "" {
-		namespace = providers.CurrentKubernetesNamespace()
+	if o.Namespace == "" {
+		o.Namespace = providers.KubernetesNamespaceForCluster(o.Cluster)
 	}
 
-	if expirationSeconds < 0 {
-		return nil, builtins.NewOperandErr(1, "argument `expiration_seconds` must be greater than or equal to 0")
+	if o.ExpirationSeconds < 0 {
+		return builtins.NewOperandErr(1, "argument `expiration_seconds` must be greater than or equal to 0")
 	}
+	return nil
+}
 
-	hasBoundObject := boundObjectKind != "" || boundObjectName != "" || boundObjectUID != ""
+// Request a service account token from the cluster
+func (o *kubernetesTokenOptions) createToken(ctx context.Context) (string, error) {
+	hasBoundObject := o.BoundObjectKind != "" || o.BoundObjectName != "" || o.BoundObjectUID != ""
 	tokenRequest := &authv1.TokenRequest{}
 
-	if len(audiences) > 0 || expirationSeconds > 0 || hasBoundObject {
+	if len(o.Audiences) > 0 || o.ExpirationSeconds > 0 || hasBoundObject {
 		tokenRequest.Spec = authv1.TokenRequestSpec{
-			Audiences: audiences,
+			Audiences: o.Audiences,
 		}
 
-		if expirationSeconds > 0 {
+		if o.ExpirationSeconds > 0 {
+			expirationSeconds := o.ExpirationSeconds
 			tokenRequest.Spec.ExpirationSeconds = &expirationSeconds
 		}
 
 		if hasBoundObject {
 			tokenRequest.Spec.BoundObjectRef = &authv1.BoundObjectReference{
-				Kind: boundObjectKind,
-				Name: boundObjectName,
-				UID:  k8stypes.UID(boundObjectUID),
+				Kind: o.BoundObjectKind,
+				Name: o.BoundObjectName,
+				UID:  k8stypes.UID(o.BoundObjectUID),
 			}
 		}
 	}
 
-	client, err := newKubernetesServiceAccountTokenClient()
+	client, err := newKubernetesServiceAccountTokenClient(o.Cluster)
+	if err != nil {
+		return "", err
+	}
+
+	return client.CreateToken(ctx, o.Namespace, o.ServiceAccount, tokenRequest)
+}
+
+func builtinKubernetesServiceAccountToken(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+	obj, err := builtins.ObjectOperand(op.Value, 1)
 	if err != nil {
 		return nil, err
 	}
 
-	token, err := client.CreateToken(bctx.Context, namespace, serviceAccount, tokenRequest)
+	options := kubernetesTokenOptions{}
+	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
+		key, err := builtins.StringOperand(keyTerm.Value, 1)
+		if err != nil {
+			return err
+		}
+		_, err = options.parse(key, valueTerm)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+
+	token, err := options.createToken(bctx.Context)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,148 @@
+package builtins
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/ezoidc/ezoidc/pkg/models"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/topdown"
+)
+
+// Usage of a single evaluation against its limits, carried by the evaluation context
+type evalLimits struct {
+	config *models.Limits
+
+	mu            sync.Mutex
+	httpRequests  int
+	builtinErrors int
+	exceeded      *models.LimitError
+}
+
+type limitsKey struct{}
+
+// Track the usage of the evaluation running with the returned context
+func WithLimits(ctx context.Context, limits *models.Limits) context.Context {
+	if limits == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, limitsKey{}, &evalLimits{config: limits})
+}
+
+// The first limit exceeded by the evaluation running with ctx, nil if none
+func LimitExceeded(ctx context.Context) *models.LimitError {
+	limits := limitsFrom(ctx)
+	if limits == nil {
+		return nil
+	}
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+	return limits.exceeded
+}
+
+func limitsFrom(ctx context.Context) *evalLimits {
+	limits, _ := ctx.Value(limitsKey{}).(*evalLimits)
+	return limits
+}
+
+// Record the first exceeded limit, later ones are a consequence of the abort
+func (l *evalLimits) exceed(reason string, format string, args ...any) *models.LimitError {
+	if l.exceeded == nil {
+		l.exceeded = &models.LimitError{Reason: reason, Message: fmt.Sprintf(format, args...)}
+	}
+	return l.exceeded
+}
+
+func (l *evalLimits) httpRequest() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.httpRequests++
+	if max := l.config.MaxHTTPRequests; max > 0 && l.httpRequests > max {
+		return l.exceed(models.ReasonLimitHTTPRequests, "evaluation exceeded the limit of %d HTTP requests", max)
+	}
+	return nil
+}
+
+func (l *evalLimits) builtinError() *models.LimitError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.builtinErrors++
+	if max := l.config.MaxBuiltinErrors; max > 0 && l.builtinErrors > max {
+		return l.exceed(models.ReasonLimitBuiltinErrors, "evaluation exceeded the limit of %d builtin errors", max)
+	}
+	return l.exceeded
+}
+
+func (l *evalLimits) responseTooLarge() *models.LimitError {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.exceed(models.ReasonLimitResponseSize, "HTTP response exceeded the limit of %d bytes", l.config.MaxResponseSize)
+}
+
+// Count the error of a builtin, halting the evaluation once a limit is exceeded
+func limitBuiltinError(bctx topdown.BuiltinContext, err error) error {
+	limits := limitsFrom(bctx.Context)
+	if limits == nil {
+		return err
+	}
+	if exceeded := limits.builtinError(); exceeded != nil {
+		return rego.NewHaltError(exceeded)
+	}
+	return err
+}
+
+// Count the requests of the evaluation and bound the size of their responses
+type limitsRoundTripper struct {
+	base   http.RoundTripper
+	limits *evalLimits
+}
+
+func (t *limitsRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limits.httpRequest(); err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	max := t.limits.config.MaxResponseSize
+	if max <= 0 {
+		return resp, nil
+	}
+	if resp.ContentLength > max {
+		resp.Body.Close()
+		return nil, t.limits.responseTooLarge()
+	}
+	resp.Body = &limitedBody{body: resp.Body, remaining: max, limits: t.limits}
+	return resp, nil
+}
+
+// Response body failing once more than the allowed bytes are read
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+	limits    *evalLimits
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, b.limits.responseTooLarge()
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, b.limits.responseTooLarge()
+	}
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,138 @@
+package builtins
+
+import (
+	"time"
+
+	"github.com/ezoidc/ezoidc/pkg/audit"
+	"github.com/google/uuid"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/topdown"
+	"github.com/open-policy-agent/opa/v1/topdown/builtins"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+var mintJWT = &rego.Function{
+	Name: "mint_jwt",
+	Decl: types.NewFunction(
+		types.Args(types.NewObject(
+			[]*types.StaticProperty{
+				types.NewStaticProperty("audience", types.NewAny(types.S, types.NewArray(nil, types.S))),
+			},
+			types.NewDynamicProperty(types.S, types.A),
+		)),
+		types.S,
+	),
+}
+
+// Claims set by the server that the policy cannot override
+var mintJWTReservedClaims = []string{"iss", "aud", "iat", "nbf", "exp", "jti"}
+
+// Signs a token with the server keys. The subject defaults to the subject of
+// the authenticated token so that relying parties see the original workload.
+func builtinMintJWT(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+	keys := environment(bctx.Context).SigningKeys
+	if keys == nil {
+		return nil, builtins.NewOperandErr(1, "signing is not configured")
+	}
+
+	obj, err := builtins.ObjectOperand(op.Value, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var audience []string
+	var subject string
+	claims := map[string]any{}
+	ttl := 15 * time.Minute
+
+	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
+		key, err := builtins.StringOperand(keyTerm.Value, 1)
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "audience":
+			if s, ok := valueTerm.Value.(ast.String); ok {
+				audience = []string{string(s)}
+				break
+			}
+			audience, err = argStringArray(key, valueTerm)
+		case "subject":
+			subject, err = argString(key, valueTerm)
+		case "claims":
+			if _, ok := valueTerm.Value.(ast.Object); !ok {
+				return argError(string(key), valueTerm, "object")
+			}
+			var v any
+			v, err = ast.JSON(valueTerm.Value)
+			if err == nil {
+				claims = v.(map[string]any)
+			}
+		case "ttl":
+			var v string
+			v, err = argString(key, valueTerm)
+			if err != nil {
+				return err
+			}
+			ttl, err = time.ParseDuration(v)
+			if err != nil || ttl <= 0 {
+				return builtins.NewOperandErr(1, "argument `ttl` must be a positive duration")
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(audience) == 0 {
+		return nil, builtins.NewOperandErr(1, "argument `audience` must not be empty")
+	}
+	for _, claim := range mintJWTReservedClaims {
+		if _, ok := claims[claim]; ok {
+			return nil, builtins.NewOperandErr(1, "argument `claims` must not contain the reserved claim `%s`", claim)
+		}
+	}
+	if maxTTL := keys.MaxTTL(); maxTTL > 0 && ttl > maxTTL {
+		return nil, builtins.NewOperandErr(1, "argument `ttl` must not exceed the key rotation period of %s", maxTTL)
+	}
+
+	if subject == "" {
+		if s, ok := claims["sub"].(string); ok {
+			subject = s
+		} else {
+			subject, _ = claimsFrom(bctx.Context)["sub"].(string)
+		}
+	}
+
+	now := time.Now()
+	jti := uuid.NewString()
+	claims["iss"] = keys.Issuer
+	claims["sub"] = subject
+	claims["aud"] = audience
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["exp"] = now.Add(ttl).Unix()
+	claims["jti"] = jti
+	if len(audience) == 1 {
+		claims["aud"] = audience[0]
+	}
+
+	token, kid, err := keys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	resultExpires(bctx.Context, now.Add(ttl))
+	audit.Log(bctx.Context, "jwt.mint").
+		Str("jti", jti).
+		Str("sub", subject).
+		Strs("aud", audience).
+		Str("kid", kid).
+		Time("expiration", now.Add(ttl)).
+		Msg("minted jwt")
+
+	return ast.StringTerm(token), nil
+}
@@ -0,0 +1,283 @@
+package builtins
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ezoidc/ezoidc/pkg/audit"
+	"github.com/ezoidc/ezoidc/pkg/signing"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/google/uuid"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/topdown"
+	"github.com/open-policy-agent/opa/v1/topdown/builtins"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+var oauth2ClientCredentials = &rego.Function{
+	Name: "oauth2_client_credentials",
+	Decl: types.NewFunction(
+		types.Args(types.NewObject(
+			[]*types.StaticProperty{
+				types.NewStaticProperty("token_url", types.S),
+				types.NewStaticProperty("client_id", types.S),
+			},
+			types.NewDynamicProperty(types.S, types.A),
+		)),
+		types.NewObject(
+			[]*types.StaticProperty{
+				types.NewStaticProperty("access_token", types.S),
+				types.NewStaticProperty("token_type", types.S),
+			},
+			types.NewDynamicProperty(types.S, types.S),
+		),
+	),
+}
+
+const (
+	oauth2AuthClientSecretBasic = "client_secret_basic"
+	oauth2AuthClientSecretPost  = "client_secret_post"
+	oauth2AuthPrivateKeyJWT     = "private_key_jwt"
+
+	// Tokens are reused until this long before they expire
+	oauth2RefreshMargin = time.Minute
+)
+
+// Parameters set from the other options, which `params` cannot override
+var oauth2ReservedParams = map[string]bool{
+	"grant_type":            true,
+	"scope":                 true,
+	"audience":              true,
+	"client_id":             true,
+	"client_secret":         true,
+	"client_assertion":      true,
+	"client_assertion_type": true,
+}
+
+// Access tokens by token URL, client, scopes and parameters
+var oauth2Cache = newCredentialCache()
+
+type oauth2ClientCredentialsOptions struct {
+	TokenURL     string            `json:"token_url"`
+	ClientID     string            `json:"client_id"`
+	ClientSecret string            `json:"client_secret"`
+	AuthMethod   string            `json:"auth_method"`
+	PrivateKey   string            `json:"private_key"`
+	KeyID        string            `json:"key_id"`
+	Scopes       []string          `json:"scopes"`
+	Audience     string            `json:"audience"`
+	Params       map[string]string `json:"params"`
+}
+
+type oauth2TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+func builtinOAuth2ClientCredentials(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+	obj, err := builtins.ObjectOperand(op.Value, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	options := oauth2ClientCredentialsOptions{}
+	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
+		key, err := builtins.StringOperand(keyTerm.Value, 1)
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "token_url":
+			options.TokenURL, err = argString(key, valueTerm)
+		case "client_id":
+			options.ClientID, err = argString(key, valueTerm)
+		case "client_secret":
+			options.ClientSecret, err = argString(key, valueTerm)
+		case "auth_method":
+			options.AuthMethod, err = argString(key, valueTerm)
+		case "private_key":
+			options.PrivateKey, err = argString(key, valueTerm)
+		case "key_id":
+			options.KeyID, err = argString(key, valueTerm)
+		case "scopes":
+			options.Scopes, err = argStringArray(key, valueTerm)
+		case "audience":
+			options.Audience, err = argString(key, valueTerm)
+		case "params":
+			options.Params, err = argStringMap(key, valueTerm)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for k := range options.Params {
+		if oauth2ReservedParams[k] {
+			return nil, builtins.NewOperandErr(1, "argument `params` must not contain the reserved parameter `%s`", k)
+		}
+	}
+	if options.TokenURL == "" || options.ClientID == "" {
+		return nil, builtins.NewOperandErr(1, "argument `token_url` and `client_id` must not be empty")
+	}
+	if options.AuthMethod == "" {
+		options.AuthMethod = oauth2AuthClientSecretBasic
+		if options.PrivateKey != "" {
+			options.AuthMethod = oauth2AuthPrivateKeyJWT
+		}
+	}
+	switch options.AuthMethod {
+	case oauth2AuthClientSecretBasic, oauth2AuthClientSecretPost:
+		if options.ClientSecret == "" {
+			return nil, builtins.NewOperandErr(1, "argument `client_secret` must not be empty with %s", options.AuthMethod)
+		}
+	case oauth2AuthPrivateKeyJWT:
+		if options.PrivateKey == "" {
+			return nil, builtins.NewOperandErr(1, "argument `private_key` must not be empty with %s", options.AuthMethod)
+		}
+	default:
+		return nil, builtins.NewOperandErr(1, "argument `auth_method` must be one of %s, %s or %s",
+			oauth2AuthClientSecretBasic, oauth2AuthClientSecretPost, oauth2AuthPrivateKeyJWT)
+	}
+
+	key, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	cacheKey := hex.EncodeToString(sum[:])
+	if value, expires, ok := oauth2Cache.lookup(cacheKey); ok {
+		resultExpires(bctx.Context, expires)
+		return value.(*ast.Term), nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(options.Scopes) > 0 {
+		form.Set("scope", strings.Join(options.Scopes, " "))
+	}
+	if options.Audience != "" {
+		form.Set("audience", options.Audience)
+	}
+	for k, v := range options.Params {
+		form.Set(k, v)
+	}
+
+	switch options.AuthMethod {
+	case oauth2AuthClientSecretPost:
+		form.Set("client_id", options.ClientID)
+		form.Set("client_secret", options.ClientSecret)
+	case oauth2AuthPrivateKeyJWT:
+		assertion, err := oauth2ClientAssertion(&options)
+		if err != nil {
+			return nil, err
+		}
+		form.Set("client_id", options.ClientID)
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", assertion)
+	}
+
+	req, err := http.NewRequestWithContext(bctx.Context, "POST", options.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if options.AuthMethod == oauth2AuthClientSecretBasic {
+		// RFC 6749 form-encodes the credentials of the basic scheme
+		req.SetBasicAuth(url.QueryEscape(options.ClientID), url.QueryEscape(options.ClientSecret))
+	}
+
+	resp, err := httpClient(bctx).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s returned status code %d: %s", options.TokenURL, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var token oauth2TokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("invalid token response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("invalid token response: missing access_token")
+	}
+
+	items := [][2]*ast.Term{
+		ast.Item(ast.StringTerm("access_token"), ast.StringTerm(token.AccessToken)),
+		ast.Item(ast.StringTerm("token_type"), ast.StringTerm(token.TokenType)),
+	}
+	if token.Scope != "" {
+		items = append(items, ast.Item(ast.StringTerm("scope"), ast.StringTerm(token.Scope)))
+	}
+
+	entry := audit.Log(bctx.Context, "oauth2.client_credentials").
+		Str("token_url", options.TokenURL).
+		Str("client_id", options.ClientID).
+		Strs("scopes", options.Scopes)
+
+	expiresIn := time.Duration(token.ExpiresIn) * time.Second
+	if expiresIn > 0 {
+		expiration := time.Now().Add(expiresIn)
+		items = append(items, ast.Item(ast.StringTerm("expiration"), ast.StringTerm(expiration.UTC().Format(time.RFC3339))))
+		entry = entry.Time("expiration", expiration)
+	}
+	entry.Msg("fetched oauth2 access token")
+
+	value := ast.ObjectTerm(items...)
+	if expiresIn > oauth2RefreshMargin {
+		oauth2Cache.set(cacheKey, value, time.Now().Add(expiresIn-oauth2RefreshMargin))
+		resultExpires(bctx.Context, time.Now().Add(expiresIn-oauth2RefreshMargin))
+	} else if expiresIn > 0 {
+		// too short-lived to be refreshed early, valid until it expires
+		resultExpires(bctx.Context, time.Now().Add(expiresIn))
+	}
+
+	return value, nil
+}
+
+// Sign the RFC 7523 client assertion of private_key_jwt authentication
+func oauth2ClientAssertion(options *oauth2ClientCredentialsOptions) (string, error) {
+	privateKey, err := signing.ParsePrivateKey(options.PrivateKey)
+	if err != nil {
+		return "", builtins.NewOperandErr(1, "invalid `private_key`: %v", err)
+	}
+
+	algorithm, err := signing.DefaultAlgorithm(privateKey)
+	if err != nil {
+		return "", builtins.NewOperandErr(1, "invalid `private_key`: %v", err)
+	}
+
+	signerOptions := (&jose.SignerOptions{}).WithType("JWT")
+	if options.KeyID != "" {
+		signerOptions = signerOptions.WithHeader("kid", options.KeyID)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: algorithm, Key: privateKey}, signerOptions)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	return jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   options.ClientID,
+		Subject:  options.ClientID,
+		Audience: jwt.Audience{options.TokenURL},
+		ID:       uuid.NewString(),
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(5 * time.Minute)),
+	}).Serialize()
+}
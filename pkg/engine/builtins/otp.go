@@ -0,0 +1,235 @@
+package builtins
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/ezoidc/ezoidc/pkg/audit"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/topdown"
+	"github.com/open-policy-agent/opa/v1/topdown/builtins"
+	"github.com/open-policy-agent/opa/v1/types"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/hotp"
+	"github.com/pquerna/otp/totp"
+)
+
+var totpGenerate = &rego.Function{
+	Name: "totp_generate",
+	Decl: types.NewFunction(types.Args(types.NewObject(
+		[]*types.StaticProperty{
+			types.NewStaticProperty("secret", types.S),
+		},
+		types.NewDynamicProperty(types.S, types.A),
+	)), types.S),
+}
+
+var hotpVerify = &rego.Function{
+	Name: "hotp_verify",
+	Decl: types.NewFunction(types.Args(types.NewObject(
+		[]*types.StaticProperty{
+			types.NewStaticProperty("secret", types.S),
+			types.NewStaticProperty("code", types.S),
+			types.NewStaticProperty("counter", types.N),
+		},
+		types.NewDynamicProperty(types.S, types.A),
+	)), types.B),
+}
+
+var hotpGenerate = &rego.Function{
+	Name: "hotp_generate",
+	Decl: types.NewFunction(types.Args(types.NewObject(
+		[]*types.StaticProperty{
+			types.NewStaticProperty("secret", types.S),
+			types.NewStaticProperty("counter", types.N),
+		},
+		types.NewDynamicProperty(types.S, types.A),
+	)), types.S),
+}
+
+var otpAlgorithms = map[string]otp.Algorithm{
+	"SHA1":   otp.AlgorithmSHA1,
+	"SHA256": otp.AlgorithmSHA256,
+	"SHA512": otp.AlgorithmSHA512,
+}
+
+// Options shared by the OTP builtins
+type otpOptions struct {
+	Secret    string
+	Code      string
+	Digits    otp.Digits
+	Algorithm otp.Algorithm
+	// TOTP
+	Time   time.Time
+	Period uint
+	Skew   uint
+	// HOTP
+	Counter    uint64
+	HasCounter bool
+}
+
+func newOTPOptions(bctx topdown.BuiltinContext) otpOptions {
+	return otpOptions{
+		Digits:    otp.DigitsSix,
+		Algorithm: otp.AlgorithmSHA1,
+		Time:      evalTime(bctx),
+	}
+}
+
+// Parse the arguments of an OTP builtin, ignoring unknown keys
+func (o *otpOptions) parse(obj ast.Object) error {
+	return obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
+		key, err := builtins.StringOperand(keyTerm.Value, 1)
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "secret":
+			o.Secret, err = argString(key, valueTerm)
+		case "code":
+			o.Code, err = argString(key, valueTerm)
+		case "digits":
+			var v int64
+			v, err = argNumber(key, valueTerm)
+			if err == nil && (v < 6 || v > 8) {
+				return builtins.NewOperandErr(1, "argument `digits` must be between 6 and 8")
+			}
+			o.Digits = otp.Digits(v)
+		case "algorithm":
+			var v string
+			v, err = argString(key, valueTerm)
+			algorithm, ok := otpAlgorithms[strings.ToUpper(v)]
+			if err == nil && !ok {
+				return builtins.NewOperandErr(1, "argument `algorithm` must be one of SHA1, SHA256 or SHA512")
+			}
+			o.Algorithm = algorithm
+		case "time":
+			var v int64
+			v, err = argNumber(key, valueTerm)
+			o.Time = time.Unix(0, v)
+		case "period":
+			var v int64
+			v, err = argNumber(key, valueTerm)
+			if err == nil && v < 0 {
+				return builtins.NewOperandErr(1, "argument `period` must not be negative")
+			}
+			o.Period = uint(v)
+		case "skew":
+			var v int64
+			v, err = argNumber(key, valueTerm)
+			if err == nil && v < 0 {
+				return builtins.NewOperandErr(1, "argument `skew` must not be negative")
+			}
+			o.Skew = uint(v)
+		case "counter":
+			var v int64
+			v, err = argNumber(key, valueTerm)
+			if err == nil && v < 0 {
+				return builtins.NewOperandErr(1, "argument `counter` must not be negative")
+			}
+			o.Counter, o.HasCounter = uint64(v), true
+		}
+		return err
+	})
+}
+
+func (o *otpOptions) totp() totp.ValidateOpts {
+	return totp.ValidateOpts{
+		Period:    o.Period,
+		Skew:      o.Skew,
+		Digits:    o.Digits,
+		Algorithm: o.Algorithm,
+	}
+}
+
+func (o *otpOptions) hotp() hotp.ValidateOpts {
+	return hotp.ValidateOpts{
+		Digits:    o.Digits,
+		Algorithm: o.Algorithm,
+	}
+}
+
+// Generates the TOTP code of a secret, so that workloads can pass 2FA without
+// holding the seed
+func builtinTotpGenerate(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+	obj, err := builtins.ObjectOperand(op.Value, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	options := newOTPOptions(bctx)
+	if err := options.parse(obj); err != nil {
+		return nil, err
+	}
+	if options.Secret == "" {
+		return nil, builtins.NewOperandErr(1, "argument `secret` must not be empty")
+	}
+
+	code, err := totp.GenerateCodeCustom(options.Secret, options.Time, options.totp())
+	if err != nil {
+		return nil, err
+	}
+
+	audit.Log(bctx.Context, "otp.generate").
+		Str("type", "totp").
+		Time("time", options.Time).
+		Msg("generated totp code")
+
+	return ast.StringTerm(code), nil
+}
+
+func builtinHotpVerify(_ topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+	obj, err := builtins.ObjectOperand(op.Value, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	options := otpOptions{Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+	if err := options.parse(obj); err != nil {
+		return nil, err
+	}
+	if options.Code == "" || options.Secret == "" || !options.HasCounter {
+		return nil, builtins.NewOperandErr(1, "argument `code`, `secret` and `counter` must not be empty")
+	}
+
+	valid, err := hotp.ValidateCustom(options.Code, options.Counter, options.Secret, options.hotp())
+	if errors.Is(err, otp.ErrValidateInputInvalidLength) {
+		// a code of another length is not the expected one
+		return ast.BooleanTerm(false), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ast.BooleanTerm(valid), nil
+}
+
+func builtinHotpGenerate(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+	obj, err := builtins.ObjectOperand(op.Value, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	options := otpOptions{Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+	if err := options.parse(obj); err != nil {
+		return nil, err
+	}
+	if options.Secret == "" || !options.HasCounter {
+		return nil, builtins.NewOperandErr(1, "argument `secret` and `counter` must not be empty")
+	}
+
+	code, err := hotp.GenerateCodeCustom(options.Secret, options.Counter, options.hotp())
+	if err != nil {
+		return nil, err
+	}
+
+	audit.Log(bctx.Context, "otp.generate").
+		Str("type", "hotp").
+		Uint64("counter", options.Counter).
+		Msg("generated hotp code")
+
+	return ast.StringTerm(code), nil
+}
@@ -0,0 +1,96 @@
+package builtins
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/topdown"
+	"github.com/open-policy-agent/opa/v1/topdown/builtins"
+)
+
+// Longest lifetime of the pre-signed URLs, the limit of S3 and GCS
+const presignMaxExpires = 7 * 24 * time.Hour
+
+// Options shared by the pre-signed URL builtins
+type presignOptions struct {
+	Method      string
+	Expires     time.Duration
+	ContentType string
+}
+
+func newPresignOptions() presignOptions {
+	return presignOptions{Method: "GET", Expires: 15 * time.Minute}
+}
+
+// Parse a shared option, returns false when the key is not one
+func (o *presignOptions) parse(key ast.String, value *ast.Term) (bool, error) {
+	var err error
+	switch key {
+	case "method":
+		o.Method, err = argString(key, value)
+		o.Method = strings.ToUpper(o.Method)
+	case "expires":
+		var v string
+		v, err = argString(key, value)
+		if err != nil {
+			return true, err
+		}
+		o.Expires, err = time.ParseDuration(v)
+		if err != nil || o.Expires < time.Second || o.Expires > presignMaxExpires {
+			return true, builtins.NewOperandErr(1, "argument `expires` must be a duration between 1s and 168h")
+		}
+	case "content_type":
+		o.ContentType, err = argString(key, value)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func (o *presignOptions) validate(methods ...string) error {
+	for _, m := range methods {
+		if o.Method == m {
+			return nil
+		}
+	}
+	return builtins.NewOperandErr(1, "argument `method` must be one of %s", strings.Join(methods, ", "))
+}
+
+// Time of the evaluation, fixed for the whole query like time.now_ns
+func evalTime(bctx topdown.BuiltinContext) time.Time {
+	if bctx.Time != nil {
+		if n, ok := bctx.Time.Value.(ast.Number); ok {
+			if ns, ok := n.Int64(); ok {
+				return time.Unix(0, ns).UTC()
+			}
+		}
+	}
+	return time.Now().UTC()
+}
+
+// Percent-encode everything but the unreserved characters, as required by
+// SigV4 and GOOG4 canonical requests
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Encode query parameters sorted by key with uriEncode
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
@@ -0,0 +1,195 @@
+package builtins
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/ezoidc/ezoidc/pkg/audit"
+	"github.com/ezoidc/ezoidc/pkg/models"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/topdown/builtins"
+)
+
+const (
+	resultCacheMaxEntries = 1000
+	resultCacheMaxTTL     = time.Hour
+)
+
+// Builtins deriving their result from the claims of the caller, such as a
+// default subject or principal templates, whose entries are also keyed by them
+var claimsKeyedBuiltins = map[string]bool{
+	awsSTSAssumeRole.Name: true,
+	mintJWT.Name:          true,
+	sshCert.Name:          true,
+}
+
+// Claims differing for every token of the same caller, left out of the key
+var perTokenClaims = []string{"exp", "iat", "nbf", "jti", "auth_time"}
+
+// Results of builtins called with the `cache` option
+type ResultCache struct {
+	entries *ttlCache
+	// Upper bound of the `cache.ttl` option
+	maxTTL time.Duration
+}
+
+// Empty cache of builtin results with the configured limits
+func NewResultCache(config *models.Cache) *ResultCache {
+	cache := &ResultCache{entries: newTTLCache(), maxTTL: resultCacheMaxTTL}
+	cache.entries.limit = resultCacheMaxEntries
+	if config != nil {
+		if config.MaxEntries > 0 {
+			cache.entries.limit = config.MaxEntries
+		}
+		if config.MaxTTL > 0 {
+			cache.maxTTL = config.MaxTTL
+		}
+	}
+	return cache
+}
+
+// Call a builtin, reusing its result when the `cache` option is set. The
+// entry is keyed by the builtin, the policy chosen key and the remaining
+// arguments, so that a key is never shared between different calls, and by
+// the caller claims for the builtins reading them.
+func cached(bctx rego.BuiltinContext, fn *rego.Function, op *ast.Term,
+	impl func(rego.BuiltinContext, *ast.Term) (*ast.Term, error)) (*ast.Term, error) {
+	obj, ok := op.Value.(ast.Object)
+	if !ok {
+		return impl(bctx, op)
+	}
+	option := obj.Get(ast.StringTerm("cache"))
+	if option == nil {
+		return impl(bctx, op)
+	}
+
+	cache := environment(bctx.Context).ResultCache
+	if cache == nil {
+		return nil, builtins.NewOperandErr(1, "result cache is not configured")
+	}
+	key, ttl, err := cacheOption(option, cache.maxTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	args := ast.NewObject()
+	obj.Foreach(func(k, v *ast.Term) {
+		if !k.Equal(ast.StringTerm("cache")) {
+			args.Insert(k, v)
+		}
+	})
+	callerClaims := ""
+	if claimsKeyedBuiltins[fn.Name] {
+		callerClaims, err = claimsCacheKey(claimsFrom(bctx.Context))
+		if err != nil {
+			return nil, err
+		}
+	}
+	sum := sha256.Sum256([]byte(fn.Name + "\x00" + key + "\x00" + args.String() + "\x00" + callerClaims))
+	cacheKey := hex.EncodeToString(sum[:])
+
+	if value, expires, ok := cache.entries.lookup(cacheKey); ok {
+		// the result is handed to another request than the one it was issued for
+		sub, _ := claimsFrom(bctx.Context)["sub"].(string)
+		audit.Log(bctx.Context, "builtin.cache_hit").
+			Str("builtin", fn.Name).
+			Str("key", key).
+			Str("sub", sub).
+			Time("expiration", expires).
+			Msg("reused cached builtin result")
+		return value.(*ast.Term), nil
+	}
+
+	expiry := &resultExpiry{}
+	bctx.Context = context.WithValue(bctx.Context, resultExpiryKey{}, expiry)
+	value, err := impl(bctx, ast.NewTerm(args))
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(ttl)
+	if !expiry.at.IsZero() && expiry.at.Before(expires) {
+		expires = expiry.at
+	}
+	cache.entries.set(cacheKey, value, expires)
+	return value, nil
+}
+
+// Claims of the caller identifying the result of a builtin reading them
+func claimsCacheKey(claims map[string]any) (string, error) {
+	caller := map[string]any{}
+	for k, v := range claims {
+		caller[k] = v
+	}
+	for _, claim := range perTokenClaims {
+		delete(caller, claim)
+	}
+	data, err := json.Marshal(caller)
+	return string(data), err
+}
+
+// Expiry of the result of a cached builtin call
+type resultExpiry struct {
+	at time.Time
+}
+
+type resultExpiryKey struct{}
+
+// Record when the result of the builtin called with ctx stops being valid, so
+// that it is not cached longer than the credential it holds
+func resultExpires(ctx context.Context, at time.Time) {
+	if expiry, ok := ctx.Value(resultExpiryKey{}).(*resultExpiry); ok && !at.IsZero() {
+		if expiry.at.IsZero() || at.Before(expiry.at) {
+			expiry.at = at
+		}
+	}
+}
+
+// Parse the `cache` option: {"key": string, "ttl": duration}
+func cacheOption(option *ast.Term, maxTTL time.Duration) (string, time.Duration, error) {
+	obj, err := builtins.ObjectOperand(option.Value, 1)
+	if err != nil {
+		return "", 0, argError("cache", option, "object")
+	}
+
+	var key string
+	var ttl time.Duration
+	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
+		name, err := builtins.StringOperand(keyTerm.Value, 1)
+		if err != nil {
+			return err
+		}
+
+		switch name {
+		case "key":
+			key, err = argString("cache.key", valueTerm)
+		case "ttl":
+			var v string
+			v, err = argString("cache.ttl", valueTerm)
+			if err != nil {
+				return err
+			}
+			ttl, err = time.ParseDuration(v)
+			if err != nil || ttl <= 0 {
+				return builtins.NewOperandErr(1, "argument `cache.ttl` must be a positive duration")
+			}
+		default:
+			return builtins.NewOperandErr(1, "argument `cache` has an unknown option: %s", name)
+		}
+		return err
+	})
+	if err != nil {
+		return "", 0, err
+	}
+
+	if key == "" || ttl == 0 {
+		return "", 0, builtins.NewOperandErr(1, "argument `cache` must have a `key` and `ttl`")
+	}
+	if ttl > maxTTL {
+		return "", 0, builtins.NewOperandErr(1, "argument `cache.ttl` must not exceed %s", maxTTL)
+	}
+	return key, ttl, nil
+}
@@ -0,0 +1,151 @@
+package builtins
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/ezoidc/ezoidc/pkg/audit"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/topdown"
+	"github.com/open-policy-agent/opa/v1/topdown/builtins"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+var s3Presign = &rego.Function{
+	Name: "s3_presign",
+	Decl: types.NewFunction(
+		types.Args(types.NewObject(
+			[]*types.StaticProperty{
+				types.NewStaticProperty("bucket", types.S),
+				types.NewStaticProperty("object", types.S),
+			},
+			types.NewDynamicProperty(types.S, types.A),
+		)),
+		types.S,
+	),
+}
+
+// Pre-signs an S3 request with SigV4 query parameters. Credentials default to
+// the server's AWS credentials, and accept the output of aws_sts_assume_role.
+func builtinS3Presign(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+	obj, err := builtins.ObjectOperand(op.Value, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	options := newPresignOptions()
+	var bucket, object, endpoint string
+	var credentials map[string]string
+	region := "us-east-1"
+
+	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
+		key, err := builtins.StringOperand(keyTerm.Value, 1)
+		if err != nil {
+			return err
+		}
+		if ok, err := options.parse(key, valueTerm); ok {
+			return err
+		}
+
+		switch key {
+		case "bucket":
+			bucket, err = argString(key, valueTerm)
+		case "object":
+			object, err = argString(key, valueTerm)
+		case "region":
+			region, err = argString(key, valueTerm)
+		case "endpoint":
+			endpoint, err = argString(key, valueTerm)
+		case "credentials":
+			credentials, err = argStringMap(key, valueTerm)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if bucket == "" || object == "" {
+		return nil, builtins.NewOperandErr(1, "argument `bucket` and `object` must not be empty")
+	}
+	if err := options.validate("GET", "HEAD", "PUT", "DELETE"); err != nil {
+		return nil, err
+	}
+
+	var creds aws.Credentials
+	if credentials != nil {
+		creds = aws.Credentials{
+			AccessKeyID:     credentials["access_key_id"],
+			SecretAccessKey: credentials["secret_access_key"],
+			SessionToken:    credentials["session_token"],
+		}
+		if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+			return nil, builtins.NewOperandErr(1, "argument `credentials` must contain `access_key_id` and `secret_access_key`")
+		}
+	} else {
+		cfg, err := config.LoadDefaultConfig(bctx.Context)
+		if err != nil {
+			return nil, err
+		}
+		creds, err = cfg.Credentials.Retrieve(bctx.Context)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// virtual-hosted style unless the bucket name breaks TLS or the endpoint is custom
+	u := &url.URL{Scheme: "https"}
+	path := "/" + object
+	switch {
+	case endpoint != "":
+		base, err := url.Parse(endpoint)
+		if err != nil || base.Host == "" {
+			return nil, builtins.NewOperandErr(1, "argument `endpoint` must be a URL")
+		}
+		u.Scheme, u.Host = base.Scheme, base.Host
+		path = strings.TrimSuffix(base.Path, "/") + "/" + bucket + path
+	case strings.Contains(bucket, "."):
+		u.Host = "s3." + region + ".amazonaws.com"
+		path = "/" + bucket + path
+	case region == "us-east-1":
+		u.Host = bucket + ".s3.amazonaws.com"
+	default:
+		u.Host = bucket + ".s3." + region + ".amazonaws.com"
+	}
+	u.Path = path
+	u.RawPath = uriEncode(path, false)
+	u.RawQuery = "X-Amz-Expires=" + strconv.FormatInt(int64(options.Expires.Seconds()), 10)
+
+	req, err := http.NewRequestWithContext(bctx.Context, options.Method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if options.ContentType != "" {
+		req.Header.Set("Content-Type", options.ContentType)
+	}
+
+	now := evalTime(bctx)
+	signed, _, err := v4.NewSigner(func(o *v4.SignerOptions) {
+		o.DisableURIPathEscaping = true
+	}).PresignHTTP(bctx.Context, creds, req, "UNSIGNED-PAYLOAD", "s3", region, now)
+	if err != nil {
+		return nil, err
+	}
+
+	resultExpires(bctx.Context, now.Add(options.Expires))
+	audit.Log(bctx.Context, "s3.presign").
+		Str("method", options.Method).
+		Str("bucket", bucket).
+		Str("object", object).
+		Str("access_key_id", creds.AccessKeyID).
+		Time("expiration", now.Add(options.Expires)).
+		Msg("pre-signed s3 url")
+
+	return ast.StringTerm(signed), nil
+}
@@ -3,8 +3,15 @@ package builtins
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ezoidc/ezoidc/pkg/audit"
+	"github.com/ezoidc/ezoidc/pkg/krl"
 	"github.com/open-policy-agent/opa/v1/ast"
 	"github.com/open-policy-agent/opa/v1/rego"
 	"github.com/open-policy-agent/opa/v1/topdown"
@@ -23,11 +30,11 @@ var sshCert = &rego.Function{
 			},
 			types.NewDynamicProperty(types.S, types.A),
 		)),
-		types.S,
+		types.NewAny(types.S, types.NewObject(nil, types.NewDynamicProperty(types.S, types.A))),
 	),
 }
 
-func builtinSSHCert(_ topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+func builtinSSHCert(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
 	obj, err := builtins.ObjectOperand(op.Value, 1)
 	if err != nil {
 		return nil, err
@@ -43,6 +50,10 @@ func builtinSSHCert(_ topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
 	ttl := 22 * time.Hour
 	criticalOptions := map[string]string{}
 	extensions := map[string]string{}
+	keyIDTemplate := ""
+	principalTemplates := []string{}
+	sourceAddresses := []string{}
+	output := "authorized_key"
 
 	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
 		key, err := builtins.StringOperand(keyTerm.Value, 1)
@@ -118,6 +129,35 @@ func builtinSSHCert(_ topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
 			if ttl <= 0 {
 				return builtins.NewOperandErr(1, "argument `ttl` must be greater than 0")
 			}
+		case "key_id_template":
+			keyIDTemplate, err = argString(key, valueTerm)
+			if err != nil {
+				return err
+			}
+		case "principal_templates":
+			principalTemplates, err = argStringArray(key, valueTerm)
+			if err != nil {
+				return err
+			}
+		case "source_addresses":
+			sourceAddresses, err = argStringArray(key, valueTerm)
+			if err != nil {
+				return err
+			}
+			for _, address := range sourceAddresses {
+				_, _, cidrErr := net.ParseCIDR(address)
+				if cidrErr != nil && net.ParseIP(address) == nil {
+					return builtins.NewOperandErr(1, "argument `source_addresses` contains an invalid address: %s", address)
+				}
+			}
+		case "output":
+			output, err = argString(key, valueTerm)
+			if err != nil {
+				return err
+			}
+			if output != "authorized_key" && output != "object" {
+				return builtins.NewOperandErr(1, "argument `output` must be `authorized_key` or `object`")
+			}
 		case "critical_options":
 			criticalOptions, err = argStringMap(key, valueTerm)
 			if err != nil {
@@ -148,6 +188,17 @@ func builtinSSHCert(_ topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
 	if err != nil {
 		return nil, builtins.NewOperandErr(1, "invalid `ca_key`: %v", err)
 	}
+	// never sign with the SHA-1 based ssh-rsa algorithm
+	if caSigner.PublicKey().Type() == ssh.KeyAlgoRSA {
+		algorithmSigner, ok := caSigner.(ssh.AlgorithmSigner)
+		if !ok {
+			return nil, builtins.NewOperandErr(1, "invalid `ca_key`: RSA key does not support SHA-2 signatures")
+		}
+		caSigner, err = ssh.NewSignerWithAlgorithms(algorithmSigner, []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256})
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKeyRaw))
 	if err != nil {
@@ -164,11 +215,30 @@ func builtinSSHCert(_ topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
 		return nil, err
 	}
 
+	serial := binary.BigEndian.Uint64(serialBytes)
+	claims := claimsFrom(bctx.Context)
+	if keyIDTemplate != "" {
+		keyID, err = expandSSHTemplate(keyIDTemplate, claims, serial)
+		if err != nil {
+			return nil, builtins.NewOperandErr(1, "invalid `key_id_template`: %v", err)
+		}
+	}
+	for _, template := range principalTemplates {
+		principal, err := expandSSHTemplate(template, claims, serial)
+		if err != nil {
+			return nil, builtins.NewOperandErr(1, "invalid `principal_templates`: %v", err)
+		}
+		principals = append(principals, principal)
+	}
+	if len(sourceAddresses) > 0 {
+		criticalOptions["source-address"] = strings.Join(sourceAddresses, ",")
+	}
+
 	validBefore := validAfter + uint64(ttl.Seconds())
 	cert := &ssh.Certificate{
 		Nonce:           nonce,
 		Key:             publicKey,
-		Serial:          binary.BigEndian.Uint64(serialBytes),
+		Serial:          serial,
 		CertType:        certType,
 		KeyId:           keyID,
 		ValidPrincipals: principals,
@@ -184,5 +254,72 @@ func builtinSSHCert(_ topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
 		return nil, err
 	}
 
-	return ast.StringTerm(string(ssh.MarshalAuthorizedKey(cert))), nil
+	if store := environment(bctx.Context).SSHCertificateStore; store != nil {
+		sub, _ := claims["sub"].(string)
+		err := store.Record(krl.Record{
+			Serial:      serial,
+			KeyID:       keyID,
+			Principals:  principals,
+			Subject:     sub,
+			CAKey:       strings.TrimSpace(string(ssh.MarshalAuthorizedKey(caSigner.PublicKey()))),
+			IssuedAt:    time.Now().UTC(),
+			ValidBefore: time.Unix(int64(validBefore), 0).UTC(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to record certificate: %w", err)
+		}
+	}
+
+	caFingerprint := ssh.FingerprintSHA256(caSigner.PublicKey())
+	resultExpires(bctx.Context, time.Unix(int64(validBefore), 0))
+	audit.Log(bctx.Context, "ssh.certificate").
+		Uint64("serial", serial).
+		Str("key_id", keyID).
+		Strs("principals", principals).
+		Str("ca_fingerprint", caFingerprint).
+		Time("valid_before", time.Unix(int64(validBefore), 0)).
+		Msg("issued ssh certificate")
+
+	authorizedKey := string(ssh.MarshalAuthorizedKey(cert))
+	if output == "authorized_key" {
+		return ast.StringTerm(authorizedKey), nil
+	}
+
+	return ast.ObjectTerm(
+		ast.Item(ast.StringTerm("certificate"), ast.StringTerm(authorizedKey)),
+		// a string since serials may not be represented exactly as JSON numbers
+		ast.Item(ast.StringTerm("serial"), ast.StringTerm(strconv.FormatUint(serial, 10))),
+		ast.Item(ast.StringTerm("key_id"), ast.StringTerm(keyID)),
+		ast.Item(ast.StringTerm("valid_after"), ast.StringTerm(time.Unix(int64(validAfter), 0).UTC().Format(time.RFC3339))),
+		ast.Item(ast.StringTerm("valid_before"), ast.StringTerm(time.Unix(int64(validBefore), 0).UTC().Format(time.RFC3339))),
+		ast.Item(ast.StringTerm("ca_fingerprint"), ast.StringTerm(caFingerprint)),
+	), nil
+}
+
+// Replace ${claim} references with the value of the claim, and ${serial}
+// with the serial of the certificate. Missing claims are an error rather
+// than an empty string that would widen the key ID or principal.
+func expandSSHTemplate(template string, claims map[string]any, serial uint64) (string, error) {
+	var missing []string
+	expanded := os.Expand(template, func(key string) string {
+		if key == "serial" {
+			return strconv.FormatUint(serial, 10)
+		}
+		value, ok := claims[key]
+		if !ok || value == nil || value == "" {
+			missing = append(missing, key)
+			return ""
+		}
+		switch v := value.(type) {
+		case string:
+			return v
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return fmt.Sprint(value)
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing claims %s", strings.Join(missing, ", "))
+	}
+	return expanded, nil
 }
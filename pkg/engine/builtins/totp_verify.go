@@ -1,7 +1,7 @@
 package builtins
 
 import (
-	"time"
+	"errors"
 
 	"github.com/open-policy-agent/opa/v1/ast"
 	"github.com/open-policy-agent/opa/v1/rego"
@@ -19,74 +19,30 @@ var totpVerify = &rego.Function{
 			types.NewStaticProperty("secret", types.S),
 			types.NewStaticProperty("code", types.S),
 		},
-		types.NewDynamicProperty(types.S, types.N),
+		types.NewDynamicProperty(types.S, types.A),
 	)), types.B),
 }
 
-func builtinTotpVerify(_ topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+func builtinTotpVerify(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
 	obj, err := builtins.ObjectOperand(op.Value, 1)
 	if err != nil {
 		return nil, err
 	}
 
-	var code string
-	var secret string
-	var skew uint
-	var period uint
-	var t = time.Now()
-
-	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
-		key, err := builtins.StringOperand(keyTerm.Value, 1)
-		if err != nil {
-			return err
-		}
-
-		switch key {
-		case "code":
-			code, err = argString(key, valueTerm)
-			if err != nil {
-				return err
-			}
-		case "secret":
-			secret, err = argString(key, valueTerm)
-			if err != nil {
-				return err
-			}
-		case "time":
-			v, err := argNumber(key, valueTerm)
-			if err != nil {
-				return err
-			}
-			t = time.Unix(0, v)
-		case "skew":
-			v, err := argNumber(key, valueTerm)
-			if err != nil {
-				return err
-			}
-			skew = uint(v)
-		case "period":
-			v, err := argNumber(key, valueTerm)
-			if err != nil {
-				return err
-			}
-			period = uint(v)
-		}
-		return nil
-	})
-	if err != nil {
+	options := newOTPOptions(bctx)
+	if err := options.parse(obj); err != nil {
 		return nil, err
 	}
 
-	if code == "" || secret == "" {
+	if options.Code == "" || options.Secret == "" {
 		return nil, builtins.NewOperandErr(1, "argument `code` and `secret` must not be empty")
 	}
 
-	valid, err := totp.ValidateCustom(code, secret, t, totp.ValidateOpts{
-		Skew:      skew,
-		Period:    period,
-		Digits:    otp.DigitsSix,
-		Algorithm: otp.AlgorithmSHA1,
-	})
+	valid, err := totp.ValidateCustom(options.Code, options.Secret, options.Time, options.totp())
+	if errors.Is(err, otp.ErrValidateInputInvalidLength) {
+		// a code of another length is not the expected one
+		return ast.BooleanTerm(false), nil
+	}
 	if err != nil {
 		return nil, err
 	}
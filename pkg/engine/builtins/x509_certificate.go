@@ -0,0 +1,338 @@
+package builtins
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ezoidc/ezoidc/pkg/audit"
+	"github.com/ezoidc/ezoidc/pkg/signing"
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/open-policy-agent/opa/v1/topdown"
+	"github.com/open-policy-agent/opa/v1/topdown/builtins"
+	"github.com/open-policy-agent/opa/v1/types"
+)
+
+var x509Cert = &rego.Function{
+	Name: "x509_certificate",
+	Decl: types.NewFunction(
+		types.Args(types.NewObject(
+			[]*types.StaticProperty{
+				types.NewStaticProperty("ca_key", types.S),
+				types.NewStaticProperty("ca_cert", types.S),
+			},
+			types.NewDynamicProperty(types.S, types.A),
+		)),
+		types.S,
+	),
+}
+
+var x509KeyUsages = map[string]x509.KeyUsage{
+	"digital_signature":  x509.KeyUsageDigitalSignature,
+	"content_commitment": x509.KeyUsageContentCommitment,
+	"key_encipherment":   x509.KeyUsageKeyEncipherment,
+	"data_encipherment":  x509.KeyUsageDataEncipherment,
+	"key_agreement":      x509.KeyUsageKeyAgreement,
+	"cert_sign":          x509.KeyUsageCertSign,
+	"crl_sign":           x509.KeyUsageCRLSign,
+}
+
+var x509ExtKeyUsages = map[string]x509.ExtKeyUsage{
+	"any":              x509.ExtKeyUsageAny,
+	"server_auth":      x509.ExtKeyUsageServerAuth,
+	"client_auth":      x509.ExtKeyUsageClientAuth,
+	"code_signing":     x509.ExtKeyUsageCodeSigning,
+	"email_protection": x509.ExtKeyUsageEmailProtection,
+	"time_stamping":    x509.ExtKeyUsageTimeStamping,
+	"ocsp_signing":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// The public key is taken from the CSR after verifying its signature, while
+// the subject and SANs only come from the options so that the policy decides them.
+func builtinX509Cert(bctx topdown.BuiltinContext, op *ast.Term) (*ast.Term, error) {
+	obj, err := builtins.ObjectOperand(op.Value, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var caKeyRaw, caCertRaw, csrRaw, publicKeyRaw string
+	var dnsNames, uris, ipAddresses, emails []string
+	var permittedDNSDomains []string
+	var keyUsages []string
+	keyUsagesSet := false
+	extKeyUsages := []string{"server_auth", "client_auth"}
+	subject := pkix.Name{}
+	ttl := 24 * time.Hour
+	isCA := false
+	maxPathLen := -1
+
+	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
+		key, err := builtins.StringOperand(keyTerm.Value, 1)
+		if err != nil {
+			return err
+		}
+
+		switch key {
+		case "ca_key":
+			caKeyRaw, err = argString(key, valueTerm)
+		case "ca_cert":
+			caCertRaw, err = argString(key, valueTerm)
+		case "csr":
+			csrRaw, err = argString(key, valueTerm)
+		case "public_key":
+			publicKeyRaw, err = argString(key, valueTerm)
+		case "subject":
+			subject, err = argX509Subject(key, valueTerm)
+		case "dns_names":
+			dnsNames, err = argStringArray(key, valueTerm)
+		case "uris":
+			uris, err = argStringArray(key, valueTerm)
+		case "ip_addresses":
+			ipAddresses, err = argStringArray(key, valueTerm)
+		case "email_addresses":
+			emails, err = argStringArray(key, valueTerm)
+		case "key_usages":
+			keyUsages, err = argStringArray(key, valueTerm)
+			keyUsagesSet = true
+		case "ext_key_usages":
+			extKeyUsages, err = argStringArray(key, valueTerm)
+		case "ttl":
+			var v string
+			v, err = argString(key, valueTerm)
+			if err != nil {
+				return err
+			}
+			ttl, err = time.ParseDuration(v)
+			if err != nil {
+				return builtins.NewOperandErr(1, "argument `ttl` must be a valid duration")
+			}
+			if ttl <= 0 {
+				return builtins.NewOperandErr(1, "argument `ttl` must be greater than 0")
+			}
+		case "is_ca":
+			v, ok := valueTerm.Value.(ast.Boolean)
+			if !ok {
+				return argError(string(key), valueTerm, "boolean")
+			}
+			isCA = bool(v)
+		case "max_path_len":
+			var n int64
+			n, err = argNumber(key, valueTerm)
+			maxPathLen = int(n)
+		case "permitted_dns_domains":
+			permittedDNSDomains, err = argStringArray(key, valueTerm)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !keyUsagesSet {
+		// intermediates must be able to sign the certificates and CRLs they issue
+		keyUsages = []string{"digital_signature"}
+		if isCA {
+			keyUsages = []string{"cert_sign", "crl_sign"}
+		}
+	}
+
+	if caKeyRaw == "" || caCertRaw == "" {
+		return nil, builtins.NewOperandErr(1, "argument `ca_key` and `ca_cert` must not be empty")
+	}
+	if (csrRaw == "") == (publicKeyRaw == "") {
+		return nil, builtins.NewOperandErr(1, "exactly one of argument `csr` or `public_key` must be set")
+	}
+
+	caKey, err := signing.ParsePrivateKey(caKeyRaw)
+	if err != nil {
+		return nil, builtins.NewOperandErr(1, "invalid `ca_key`: %v", err)
+	}
+	caChain, err := parseCertificates(caCertRaw)
+	if err != nil {
+		return nil, builtins.NewOperandErr(1, "invalid `ca_cert`: %v", err)
+	}
+	caCert := caChain[0]
+
+	var publicKey crypto.PublicKey
+	if csrRaw != "" {
+		block, _ := pem.Decode([]byte(csrRaw))
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			return nil, builtins.NewOperandErr(1, "invalid `csr`: no CERTIFICATE REQUEST PEM block found")
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			return nil, builtins.NewOperandErr(1, "invalid `csr`: %v", err)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			return nil, builtins.NewOperandErr(1, "invalid `csr` signature: %v", err)
+		}
+		publicKey = csr.PublicKey
+	} else {
+		block, _ := pem.Decode([]byte(publicKeyRaw))
+		if block == nil {
+			return nil, builtins.NewOperandErr(1, "invalid `public_key`: no PEM block found")
+		}
+		publicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, builtins.NewOperandErr(1, "invalid `public_key`: %v", err)
+		}
+	}
+
+	template := &x509.Certificate{
+		Subject:               subject,
+		DNSNames:              dnsNames,
+		EmailAddresses:        emails,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		PermittedDNSDomains:   permittedDNSDomains,
+	}
+
+	for _, u := range uris {
+		parsed, err := url.Parse(u)
+		if err != nil || parsed.Scheme == "" {
+			return nil, builtins.NewOperandErr(1, "argument `uris` contains an invalid URI: %s", u)
+		}
+		template.URIs = append(template.URIs, parsed)
+	}
+	for _, ip := range ipAddresses {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return nil, builtins.NewOperandErr(1, "argument `ip_addresses` contains an invalid IP address: %s", ip)
+		}
+		template.IPAddresses = append(template.IPAddresses, parsed)
+	}
+	for _, usage := range keyUsages {
+		v, ok := x509KeyUsages[usage]
+		if !ok {
+			return nil, builtins.NewOperandErr(1, "argument `key_usages` contains an unknown usage: %s", usage)
+		}
+		template.KeyUsage |= v
+	}
+	for _, usage := range extKeyUsages {
+		v, ok := x509ExtKeyUsages[usage]
+		if !ok {
+			return nil, builtins.NewOperandErr(1, "argument `ext_key_usages` contains an unknown usage: %s", usage)
+		}
+		template.ExtKeyUsage = append(template.ExtKeyUsage, v)
+	}
+
+	if maxPathLen >= 0 {
+		if !isCA {
+			return nil, builtins.NewOperandErr(1, "argument `max_path_len` requires `is_ca`")
+		}
+		template.MaxPathLen = maxPathLen
+		template.MaxPathLenZero = maxPathLen == 0
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+
+	now := time.Now()
+	template.NotBefore = now.Add(-time.Minute)
+	if template.NotBefore.Before(caCert.NotBefore) {
+		template.NotBefore = caCert.NotBefore
+	}
+	template.NotAfter = now.Add(ttl)
+	if template.NotAfter.After(caCert.NotAfter) {
+		template.NotAfter = caCert.NotAfter
+	}
+	if !template.NotAfter.After(now) {
+		return nil, builtins.NewOperandErr(1, "argument `ca_cert` has expired")
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, publicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+
+	resultExpires(bctx.Context, template.NotAfter)
+	audit.Log(bctx.Context, "x509.certificate").
+		Str("serial", fmt.Sprintf("%x", serial)).
+		Str("subject", template.Subject.String()).
+		Strs("dns_names", dnsNames).
+		Strs("uris", uris).
+		Str("issuer", caCert.Subject.String()).
+		Time("not_after", template.NotAfter).
+		Msg("issued x509 certificate")
+
+	var chain strings.Builder
+	_ = pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	for _, cert := range caChain {
+		_ = pem.Encode(&chain, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+
+	return ast.StringTerm(chain.String()), nil
+}
+
+func argX509Subject(key ast.String, value *ast.Term) (pkix.Name, error) {
+	name := pkix.Name{}
+	obj, err := builtins.ObjectOperand(value.Value, 1)
+	if err != nil {
+		return name, argError(string(key), value, "object")
+	}
+
+	err = obj.Iter(func(keyTerm *ast.Term, valueTerm *ast.Term) error {
+		field, err := builtins.StringOperand(keyTerm.Value, 1)
+		if err != nil {
+			return err
+		}
+
+		switch field {
+		case "common_name":
+			name.CommonName, err = argString("subject."+field, valueTerm)
+		case "serial_number":
+			name.SerialNumber, err = argString("subject."+field, valueTerm)
+		case "organization":
+			name.Organization, err = argStringArray("subject."+field, valueTerm)
+		case "organizational_unit":
+			name.OrganizationalUnit, err = argStringArray("subject."+field, valueTerm)
+		case "country":
+			name.Country, err = argStringArray("subject."+field, valueTerm)
+		case "province":
+			name.Province, err = argStringArray("subject."+field, valueTerm)
+		case "locality":
+			name.Locality, err = argStringArray("subject."+field, valueTerm)
+		default:
+			return builtins.NewOperandErr(1, "argument `subject` contains an unknown field: %s", field)
+		}
+		return err
+	})
+	return name, err
+}
+
+// Parse one or more PEM encoded certificates
+func parseCertificates(data string) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no CERTIFICATE PEM block found")
+	}
+	return certs, nil
+}
@@ -4,12 +4,17 @@ import (
 	"context"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
 
-	_ "github.com/ezoidc/ezoidc/pkg/engine/builtins"
+	"github.com/ezoidc/ezoidc/pkg/audit"
+	"github.com/ezoidc/ezoidc/pkg/egress"
+	"github.com/ezoidc/ezoidc/pkg/engine/builtins"
+	"github.com/ezoidc/ezoidc/pkg/krl"
 	"github.com/ezoidc/ezoidc/pkg/models"
 	"github.com/ezoidc/ezoidc/pkg/providers"
+	"github.com/ezoidc/ezoidc/pkg/signing"
 	"github.com/ezoidc/ezoidc/pkg/static"
 	"github.com/open-policy-agent/opa/v1/ast"
 	"github.com/open-policy-agent/opa/v1/rego"
@@ -22,8 +27,21 @@ import (
 const (
 	QueryAllowedVariables  = "allowed_variables"
 	QueryVariablesResponse = "variables_response"
+	QueryAllowedWrite      = "allowed_write"
+	QueryTokenExchange     = "token_exchange"
 )
 
+var (
+	ErrWriteDenied          = errors.New("write denied by policy")
+	ErrNotWritable          = errors.New("variable provider does not support writes")
+	ErrWriteFailed          = errors.New("failed to write variable")
+	ErrExchangeDenied       = errors.New("token exchange denied by policy")
+	ErrUnsupportedTokenType = errors.New("unsupported requested_token_type")
+)
+
+// Type of the exchanged token when the exchange rule does not set issued_token_type
+const TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
 type Engine struct {
 	// Variable resolver
 	Resolver *providers.Resolver
@@ -33,6 +51,11 @@ type Engine struct {
 	Query rego.PreparedEvalQuery
 	// Engine configuration
 	Configuration *models.Configuration
+	// Keys signing the tokens minted by the policy
+	Signing *signing.KeySet
+
+	// State of the builtins, replaced on every compilation
+	environment *builtins.Environment
 }
 
 type EngineInput struct {
@@ -46,6 +69,10 @@ type EngineInput struct {
 	Allow map[string]string `json:"allow"`
 	// User-provided parameters
 	Params map[string]any `json:"params"`
+	// Name of the variable to write
+	Name string `json:"name,omitempty"`
+	// Token exchange request
+	Exchange *ExchangeRequest `json:"exchange,omitempty"`
 }
 
 type ReadRequest struct {
@@ -75,6 +102,32 @@ var ezoidcRego string
 
 // Prepare the engine for evaluation
 func (e *Engine) Compile(ctx context.Context) error {
+	err := e.Resolver.Configure(ctx, e.Configuration.Providers)
+	if err != nil {
+		return err
+	}
+
+	env := &builtins.Environment{
+		ResultCache: builtins.NewResultCache(e.Configuration.Cache),
+	}
+	if e.Configuration.SSHStore != "" {
+		env.SSHCertificateStore = krl.NewStore(e.Configuration.SSHStore)
+	}
+
+	e.Signing = nil
+	if e.Configuration.Signing != nil {
+		e.Signing, err = signing.NewKeySet(e.Configuration.Signing)
+		if err != nil {
+			return err
+		}
+	}
+	env.SigningKeys = e.Signing
+
+	env.Egress, err = egress.New(e.Configuration.Egress)
+	if err != nil {
+		return err
+	}
+
 	c, err := ast.CompileModulesWithOpt(map[string]string{
 		"ezoidc.rego": ezoidcRego,
 		"policy.rego": "package ezoidc\n" + e.Configuration.Policy,
@@ -124,6 +177,7 @@ func (e *Engine) Compile(ctx context.Context) error {
 	}
 
 	e.Query = query
+	e.environment = env
 	return nil
 }
 
@@ -143,11 +197,33 @@ func (e *Engine) AllowedVariables(ctx context.Context, req *ReadRequest) (map[st
 
 // Given validated claims, read allowed variable values
 func (e *Engine) ReadVariables(ctx context.Context, req *ReadRequest) (*ReadResponse, error) {
-	allowed, err := e.AllowedVariables(ctx, req)
+	allowed, resolvedVariables, err := e.resolveAllowed(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &ReadResponse{Allowed: allowed}
+	input := &EngineInput{
+		Query:     QueryVariablesResponse,
+		Variables: resolvedVariables,
+		Allow:     allowed,
+	}
+	input.setRequest(req)
+	err = e.eval(ctx, input, &response.Variables)
 	if err != nil {
 		return nil, err
 	}
 
+	return response, nil
+}
+
+// Resolve the values of the variables allowed for the request, with their scope
+func (e *Engine) resolveAllowed(ctx context.Context, req *ReadRequest) (map[string]string, []models.Variable, error) {
+	allowed, err := e.AllowedVariables(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	allowedVariables := []models.Variable{}
 	for _, v := range e.Configuration.Variables {
 		if allowed[v.Name] != "" {
@@ -157,21 +233,172 @@ func (e *Engine) ReadVariables(ctx context.Context, req *ReadRequest) (*ReadResp
 
 	resolvedVariables, err := e.Resolver.Resolve(ctx, allowedVariables)
 	if err != nil {
+		return nil, nil, err
+	}
+
+	// expanded variables share the scope of their parent
+	for _, v := range resolvedVariables {
+		if v.Parent != "" {
+			allowed[v.Name] = allowed[v.Parent]
+		}
+	}
+	return allowed, resolvedVariables, nil
+}
+
+type WriteRequest struct {
+	// Validated JWT claims
+	Claims map[string]any `json:"claims"`
+	// User-provided parameters
+	Params map[string]any `json:"params"`
+	// Name of the variable to write
+	Name string `json:"name"`
+	// New value of the variable
+	Value string `json:"-"`
+}
+
+// Given validated claims, write the value of a variable if allowed by the policy.
+// Unknown variables are denied like forbidden ones so that names cannot be probed.
+func (e *Engine) WriteVariable(ctx context.Context, req *WriteRequest) error {
+	var variable *models.Variable
+	for i, v := range e.Configuration.Variables {
+		if v.Name == req.Name {
+			variable = &e.Configuration.Variables[i]
+			break
+		}
+	}
+
+	sub, _ := req.Claims["sub"].(string)
+	iss, _ := req.Claims["iss"].(string)
+	entry := func(err error) {
+		event := audit.Log(ctx, "variable.write").
+			Err(err).
+			Str("variable", req.Name).
+			Str("sub", sub).
+			Str("iss", iss)
+		if variable != nil {
+			event = event.Str("provider", variable.Value.Provider)
+		}
+		event.Msg("write variable")
+	}
+
+	allowed := false
+	input := &EngineInput{
+		Query:  QueryAllowedWrite,
+		Claims: req.Claims,
+		Params: req.Params,
+		Name:   req.Name,
+	}
+	err := e.eval(ctx, input, &allowed)
+	if err != nil {
+		entry(err)
+		return err
+	}
+	if !allowed || variable == nil {
+		entry(ErrWriteDenied)
+		return ErrWriteDenied
+	}
+
+	provider, id := e.Resolver.ForVariable(*variable)
+	writer, ok := provider.(providers.VariableWriter)
+	if expander, isExpander := provider.(providers.VariableExpander); isExpander && expander.Expands(id) {
+		ok = false
+	}
+	if !ok {
+		entry(ErrNotWritable)
+		return ErrNotWritable
+	}
+
+	err = writer.Write(ctx, id, req.Value)
+	entry(err)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrWriteFailed, err)
+	}
+	return nil
+}
+
+type ExchangeRequest struct {
+	// Validated JWT claims of the subject token
+	Claims map[string]any `json:"-"`
+	// Audience or resource the token is requested for, the key of the exchange rule
+	Target             string   `json:"target"`
+	Audience           []string `json:"audience"`
+	Resource           []string `json:"resource"`
+	Scope              []string `json:"scope"`
+	RequestedTokenType string   `json:"requested_token_type"`
+}
+
+type ExchangeResponse struct {
+	Token           string `json:"token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in"`
+	Scope           string `json:"scope"`
+}
+
+// Given validated claims, evaluate the exchange rule of the requested target.
+// The rule either returns the token or an object overriding the response fields.
+func (e *Engine) ExchangeToken(ctx context.Context, req *ExchangeRequest) (*ExchangeResponse, error) {
+	sub, _ := req.Claims["sub"].(string)
+	iss, _ := req.Claims["iss"].(string)
+	entry := func(err error) {
+		audit.Log(ctx, "token.exchange").
+			Err(err).
+			Str("target", req.Target).
+			Strs("scope", req.Scope).
+			Str("sub", sub).
+			Str("iss", iss).
+			Msg("exchange token")
+	}
+
+	readRequest := &ReadRequest{Claims: req.Claims}
+	allowed, resolvedVariables, err := e.resolveAllowed(ctx, readRequest)
+	if err != nil {
+		entry(err)
 		return nil, err
 	}
 
-	response := &ReadResponse{Allowed: allowed}
+	var result any
 	input := &EngineInput{
-		Query:     QueryVariablesResponse,
+		Query:     QueryTokenExchange,
 		Variables: resolvedVariables,
 		Allow:     allowed,
+		Exchange:  req,
 	}
-	input.setRequest(req)
-	err = e.eval(ctx, input, &response.Variables)
+	input.setRequest(readRequest)
+	err = e.eval(ctx, input, &result)
 	if err != nil {
+		entry(err)
 		return nil, err
 	}
 
+	response := &ExchangeResponse{
+		IssuedTokenType: TokenTypeAccessToken,
+		TokenType:       "Bearer",
+	}
+	switch v := result.(type) {
+	case string:
+		response.Token = v
+	case map[string]any:
+		data, _ := json.Marshal(v)
+		err = json.Unmarshal(data, response)
+		if err != nil {
+			err = fmt.Errorf("invalid exchange[%q] result: %w", req.Target, err)
+			entry(err)
+			return nil, err
+		}
+	}
+	if response.Token == "" {
+		entry(ErrExchangeDenied)
+		return nil, ErrExchangeDenied
+	}
+	// the rule decides the type of the token, a client cannot relabel it
+	if req.RequestedTokenType != "" && req.RequestedTokenType != response.IssuedTokenType {
+		err := fmt.Errorf("%w: %s", ErrUnsupportedTokenType, req.RequestedTokenType)
+		entry(err)
+		return nil, err
+	}
+
+	entry(nil)
 	return response, nil
 }
 
@@ -198,10 +425,28 @@ func (e *Engine) Print(ctx print.Context, msg string) error {
 }
 
 func (e *Engine) eval(ctx context.Context, input *EngineInput, out interface{}) error {
-	rs, err := e.Query.Eval(ctx,
+	limits := e.Configuration.Limits
+	evalCtx := builtins.WithEnvironment(ctx, e.environment)
+	evalCtx = builtins.WithLimits(builtins.WithClaims(evalCtx, input.Claims), limits)
+	if limits != nil && limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		evalCtx, cancel = context.WithTimeout(evalCtx, limits.Timeout)
+		defer cancel()
+	}
+
+	rs, err := e.Query.Eval(evalCtx,
 		rego.EvalInput(input),
 		rego.EvalPrintHook(e),
 	)
+	if exceeded := builtins.LimitExceeded(evalCtx); exceeded != nil {
+		return exceeded
+	}
+	if ctx.Err() == nil && errors.Is(evalCtx.Err(), context.DeadlineExceeded) {
+		return &models.LimitError{
+			Reason:  models.ReasonLimitTimeout,
+			Message: fmt.Sprintf("evaluation exceeded the timeout of %s", limits.Timeout),
+		}
+	}
 	if err != nil {
 		return err
 	}
@@ -6,8 +6,12 @@ allow.read(name) if false
 
 allow.internal(name) if false
 
+allow.write(name) if false
+
 define.nil if false
 
+exchange.nil if false
+
 issuers[key] := data.issuers[key] if {
 	some key
 }
@@ -20,6 +24,10 @@ params[key] := input.params[key] if {
 	some key
 }
 
+exchange_request[key] := input.exchange[key] if {
+	some key
+}
+
 read(name) := var.value.string if {
 	some var in input.variables
 	var.name == name
@@ -53,6 +61,15 @@ _variable_scope(name) := "read" if {
 	allow.internal(name)
 }
 
+_queries.allowed_write := true if {
+	input.name in data.variable_names
+	allow.write(input.name)
+} else := false
+
+_queries.token_exchange := token if {
+	token := exchange[input.exchange.target]
+} else := null
+
 _queries.variables_response contains object.union(vars, defs)[_] if {
 	vars := {var.name: var |
 		input.allow[name] == "read"
@@ -94,21 +111,6 @@ github_app_jwt(options) := token if {
 	false
 }
 
-github_app_installation_token(options) := response.token if {
-	url := $"https://api.github.com/app/installations/{options.installation_id}/access_tokens"
-	body := object.get(options, "body", {})
-	app_token := github_app_jwt(object.filter(options, ["app_id", "private_key"]))
-	response := fetch({
-		"url": url,
-		"method": "POST",
-		"headers": {"Authorization": $"Bearer {app_token}"},
-		"body": body,
-	}).body
-} else if {
-	print("warn: github.app.installation_token: failed to fetch installation token")
-	false
-}
-
 cloudflare_r2_temporary_credentials(options) := response if {
 	url := $"https://api.cloudflare.com/client/v4/accounts/{options.account_id}/r2/temp-access-credentials"
 	defaults := {
@@ -0,0 +1,79 @@
+package krl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Constants of the OpenSSH KRL format, see PROTOCOL.krl
+const (
+	krlMagic                 = 0x5353484b524c0a00
+	krlFormatVersion         = 1
+	krlSectionCertificates   = 1
+	krlSectionCertSerialList = 0x20
+)
+
+// Encode the revoked records as an OpenSSH KRL, grouping serials by CA.
+// The generation time is used as the KRL version.
+func Generate(records []Record, now time.Time) ([]byte, error) {
+	serialsByCA := map[string][]uint64{}
+	caKeys := map[string]ssh.PublicKey{}
+	for _, r := range records {
+		if r.RevokedAt == nil {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(r.CAKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ca key of certificate %d: %w", r.Serial, err)
+		}
+		blob := string(key.Marshal())
+		caKeys[blob] = key
+		serialsByCA[blob] = append(serialsByCA[blob], r.Serial)
+	}
+
+	out := binary.BigEndian.AppendUint64(nil, krlMagic)
+	out = binary.BigEndian.AppendUint32(out, krlFormatVersion)
+	out = binary.BigEndian.AppendUint64(out, uint64(now.Unix()))
+	out = binary.BigEndian.AppendUint64(out, uint64(now.Unix()))
+	out = binary.BigEndian.AppendUint64(out, 0) // flags
+	out = appendString(out, nil)                // reserved
+	out = appendString(out, []byte("ezoidc"))   // comment
+
+	blobs := make([]string, 0, len(caKeys))
+	for blob := range caKeys {
+		blobs = append(blobs, blob)
+	}
+	sort.Strings(blobs)
+
+	for _, blob := range blobs {
+		serials := serialsByCA[blob]
+		sort.Slice(serials, func(i, j int) bool { return serials[i] < serials[j] })
+
+		serialList := []byte{}
+		for i, serial := range serials {
+			if i > 0 && serials[i-1] == serial {
+				continue
+			}
+			serialList = binary.BigEndian.AppendUint64(serialList, serial)
+		}
+
+		section := appendString(nil, []byte(blob))
+		section = appendString(section, nil) // reserved
+		section = append(section, krlSectionCertSerialList)
+		section = appendString(section, serialList)
+
+		out = append(out, krlSectionCertificates)
+		out = appendString(out, section)
+	}
+
+	return out, nil
+}
+
+func appendString(b []byte, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
@@ -0,0 +1,185 @@
+package krl
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh.json")
+	store := NewStore(path)
+
+	records, err := store.Records()
+	assert.NoError(t, err)
+	assert.Empty(t, records)
+
+	now := time.Now().UTC()
+	for _, r := range []Record{
+		{Serial: 1, KeyID: "a", Subject: "alice", ValidBefore: now.Add(time.Hour)},
+		{Serial: 2, KeyID: "b", Subject: "bob", ValidBefore: now.Add(time.Hour)},
+		{Serial: 3, KeyID: "c", Subject: "bob", ValidBefore: now.Add(time.Hour)},
+		{Serial: 4, KeyID: "d", Subject: "carol", ValidBefore: now.Add(-time.Hour)},
+	} {
+		r.IssuedAt = now
+		assert.NoError(t, store.Record(r))
+	}
+
+	records, err = store.Records()
+	assert.NoError(t, err)
+	assert.Len(t, records, 3, "expired records are pruned")
+
+	// revocations are applied in order, already revoked records are skipped
+	cases := []struct {
+		name    string
+		filter  Filter
+		serials []uint64
+	}{
+		{name: "serial", filter: Filter{Serials: []uint64{1}}, serials: []uint64{1}},
+		{name: "again", filter: Filter{Serials: []uint64{1}}, serials: []uint64{}},
+		{name: "key id", filter: Filter{KeyIDs: []string{"b"}}, serials: []uint64{2}},
+		{name: "subject", filter: Filter{Subject: "bob"}, serials: []uint64{3}},
+		{name: "expired", filter: Filter{Serials: []uint64{4}}, serials: []uint64{}},
+		{name: "no match", filter: Filter{}, serials: []uint64{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			revoked, err := store.Revoke(c.filter)
+			assert.NoError(t, err)
+			serials := []uint64{}
+			for _, r := range revoked {
+				assert.NotNil(t, r.RevokedAt)
+				serials = append(serials, r.Serial)
+			}
+			assert.Equal(t, c.serials, serials)
+		})
+	}
+
+	records, err = NewStore(path).Records()
+	assert.NoError(t, err)
+	for _, r := range records {
+		assert.NotNil(t, r.RevokedAt, "serial %d", r.Serial)
+	}
+}
+
+func TestStoreConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh.json")
+	validBefore := time.Now().Add(time.Hour)
+
+	// the server and the CLI use separate stores on the same file
+	var wg sync.WaitGroup
+	for i := range 50 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, NewStore(path).Record(Record{Serial: uint64(i), Subject: "alice", ValidBefore: validBefore}))
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := NewStore(path).Revoke(Filter{Subject: "alice"})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	_, err := NewStore(path).Revoke(Filter{Subject: "alice"})
+	assert.NoError(t, err)
+	records, err := NewStore(path).Records()
+	assert.NoError(t, err)
+	assert.Len(t, records, 50)
+	for _, r := range records {
+		assert.NotNil(t, r.RevokedAt, "serial %d", r.Serial)
+	}
+}
+
+func TestStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh.json")
+	store := NewStore(path)
+	lines := func() int {
+		data, err := os.ReadFile(path)
+		assert.NoError(t, err)
+		return strings.Count(string(data), "\n")
+	}
+
+	for i := range compactLines {
+		assert.NoError(t, store.Record(Record{Serial: uint64(i), ValidBefore: time.Now().Add(-time.Hour)}))
+	}
+	assert.NoError(t, store.Record(Record{Serial: compactLines, ValidBefore: time.Now().Add(time.Hour)}))
+	assert.Equal(t, compactLines+1, lines(), "records are appended")
+
+	records, err := store.Records()
+	assert.NoError(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, 1, lines(), "expired records are compacted")
+}
+
+func TestStoreInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ssh.json")
+	assert.NoError(t, os.WriteFile(path, []byte("{"), 0600))
+
+	_, err := NewStore(path).Records()
+	assert.ErrorContains(t, err, "invalid ssh certificate store")
+}
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	caSigner, err := ssh.NewSignerFromSigner(caKey)
+	assert.NoError(t, err)
+	caPublicKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(caSigner.PublicKey())))
+
+	certs := map[uint64]string{}
+	for _, serial := range []uint64{10, 20} {
+		userKey, _, _ := ed25519.GenerateKey(rand.Reader)
+		userPublicKey, err := ssh.NewPublicKey(userKey)
+		assert.NoError(t, err)
+		cert := &ssh.Certificate{
+			Key:             userPublicKey,
+			Serial:          serial,
+			CertType:        ssh.UserCert,
+			KeyId:           "test",
+			ValidPrincipals: []string{"test"},
+			ValidBefore:     ssh.CertTimeInfinity,
+		}
+		assert.NoError(t, cert.SignCert(rand.Reader, caSigner))
+		certs[serial] = filepath.Join(dir, fmt.Sprintf("cert%d.pub", serial))
+		assert.NoError(t, os.WriteFile(certs[serial], ssh.MarshalAuthorizedKey(cert), 0600))
+	}
+
+	now := time.Now()
+	revokedAt := now.UTC()
+	data, err := Generate([]Record{
+		{Serial: 10, CAKey: caPublicKey, RevokedAt: &revokedAt},
+		{Serial: 10, CAKey: caPublicKey, RevokedAt: &revokedAt},
+		{Serial: 20, CAKey: caPublicKey},
+	}, now)
+	assert.NoError(t, err)
+	assert.Equal(t, "SSHKRL\n\x00", string(data[:8]))
+
+	_, err = Generate([]Record{{Serial: 1, CAKey: "invalid", RevokedAt: &revokedAt}}, now)
+	assert.Error(t, err)
+
+	sshKeygen, err := exec.LookPath("ssh-keygen")
+	if err != nil {
+		t.Skip("ssh-keygen not found")
+	}
+	krlPath := filepath.Join(dir, "krl")
+	assert.NoError(t, os.WriteFile(krlPath, data, 0600))
+
+	out, err := exec.Command(sshKeygen, "-Q", "-f", krlPath, certs[10]).CombinedOutput()
+	assert.Error(t, err, "revoked certificate: %s", out)
+	assert.Contains(t, string(out), "REVOKED")
+
+	out, err = exec.Command(sshKeygen, "-Q", "-f", krlPath, certs[20]).CombinedOutput()
+	assert.NoError(t, err, "valid certificate: %s", out)
+}
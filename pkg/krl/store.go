@@ -0,0 +1,219 @@
+// Package krl records issued SSH certificates and publishes the revoked ones
+// as an OpenSSH key revocation list (KRL).
+package krl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// An issued SSH certificate
+type Record struct {
+	Serial     uint64   `json:"serial"`
+	KeyID      string   `json:"key_id"`
+	Principals []string `json:"principals,omitempty"`
+	// Subject of the token the certificate was issued to
+	Subject string `json:"subject,omitempty"`
+	// Public key of the CA in authorized_keys format
+	CAKey       string     `json:"ca_key"`
+	IssuedAt    time.Time  `json:"issued_at"`
+	ValidBefore time.Time  `json:"valid_before"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Certificates to revoke, records matching any of the set fields are revoked
+type Filter struct {
+	Serials []uint64
+	KeyIDs  []string
+	Subject string
+}
+
+func (f *Filter) matches(r *Record) bool {
+	for _, serial := range f.Serials {
+		if r.Serial == serial {
+			return true
+		}
+	}
+	for _, keyID := range f.KeyIDs {
+		if r.KeyID == keyID {
+			return true
+		}
+	}
+	return f.Subject != "" && r.Subject == f.Subject
+}
+
+// Records appended to a JSON Lines file, a revoked certificate being appended
+// again with its revocation time. The server and the CLI share the file, so
+// every access holds an exclusive lock on a sibling .lock file. The file is
+// rewritten without the expired and superseded lines when revoking, or when
+// reading a file mostly made of them.
+type Store struct {
+	Path string
+}
+
+// Minimum number of lines before a read compacts the file
+const compactLines = 1000
+
+func NewStore(path string) *Store {
+	return &Store{Path: path}
+}
+
+// Record an issued certificate
+func (s *Store) Record(record Record) error {
+	return s.locked(func() error {
+		return s.append(record)
+	})
+}
+
+// Revoke the certificates matching the filter, returns the newly revoked records
+func (s *Store) Revoke(filter Filter) ([]Record, error) {
+	revoked := []Record{}
+	err := s.locked(func() error {
+		records, _, err := s.read()
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+		for i := range records {
+			if records[i].RevokedAt == nil && filter.matches(&records[i]) {
+				records[i].RevokedAt = &now
+				revoked = append(revoked, records[i])
+			}
+		}
+		if len(revoked) == 0 {
+			return nil
+		}
+		return s.write(records)
+	})
+	return revoked, err
+}
+
+// List the unexpired records
+func (s *Store) Records() ([]Record, error) {
+	var records []Record
+	err := s.locked(func() error {
+		var lines int
+		var err error
+		records, lines, err = s.read()
+		if err != nil || lines < compactLines || lines < 2*len(records) {
+			return err
+		}
+		return s.write(records)
+	})
+	return records, err
+}
+
+// Generate the KRL of the revoked certificates
+func (s *Store) KRL() ([]byte, error) {
+	records, err := s.Records()
+	if err != nil {
+		return nil, err
+	}
+	return Generate(records, time.Now())
+}
+
+// Run fn while holding the lock of the store, released when the file is closed
+func (s *Store) locked(fn func() error) error {
+	f, err := os.OpenFile(s.Path+".lock", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return fmt.Errorf("failed to lock ssh certificate store %s: %w", s.Path, err)
+	}
+	return fn()
+}
+
+// Unexpired records in the order they were first issued, and the number of lines read
+func (s *Store) read() ([]Record, int, error) {
+	f, err := os.Open(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Record{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	records := []Record{}
+	index := map[uint64]int{}
+	lines := 0
+	dec := json.NewDecoder(f)
+	for {
+		var r Record
+		err := dec.Decode(&r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid ssh certificate store %s: %w", s.Path, err)
+		}
+		lines++
+		if i, ok := index[r.Serial]; ok {
+			records[i] = r
+			continue
+		}
+		index[r.Serial] = len(records)
+		records = append(records, r)
+	}
+
+	now := time.Now()
+	unexpired := records[:0]
+	for _, r := range records {
+		if r.ValidBefore.After(now) {
+			unexpired = append(unexpired, r)
+		}
+	}
+	return unexpired, lines, nil
+}
+
+func (s *Store) append(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Replace the file atomically so that readers never see a partial write
+func (s *Store) write(records []Record) error {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].IssuedAt.Before(records[j].IssuedAt)
+	})
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), ".ssh-store-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	enc := json.NewEncoder(tmp)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
@@ -14,6 +14,37 @@ type VariablesResponse struct {
 	Variables []Variable `json:"variables"`
 }
 
+type WriteVariableRequest struct {
+	Token  string         `json:"-"`
+	Name   string         `json:"-"`
+	Value  string         `json:"value"`
+	Params map[string]any `json:"params"`
+}
+
+// OpenID Connect Discovery document of the server's signing keys
+type OpenIDConfiguration struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// RFC 8693 token exchange response
+type TokenExchangeResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+}
+
+// RFC 6749 error response of the token endpoint
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
 type ErrorResponse struct {
 	Error  string `json:"error"`
 	Reason string `json:"reason,omitempty"`
@@ -0,0 +1,11 @@
+package models
+
+import "time"
+
+// Limits of the in-memory cache of builtin results, selected by the `cache` option of builtins
+type Cache struct {
+	// Maximum number of cached results, defaults to 1000
+	MaxEntries int `json:"max_entries,omitempty" yaml:"max_entries"`
+	// Upper bound of the TTL requested by the policy, defaults to 1h
+	MaxTTL time.Duration `json:"max_ttl,omitempty" yaml:"max_ttl"`
+}
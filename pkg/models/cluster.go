@@ -0,0 +1,13 @@
+package models
+
+// Connection to a Kubernetes cluster
+type KubernetesCluster struct {
+	// The name of the cluster to be used by providers, builtins and issuers
+	Name string `json:"name" yaml:"-"`
+	// Path to a kubeconfig file, defaults to $KUBECONFIG or ~/.kube/config
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	// Context of the kubeconfig file, defaults to the current context
+	Context string `json:"context,omitempty"`
+	// Default namespace, defaults to the namespace of the context
+	Namespace string `json:"namespace,omitempty"`
+}
@@ -28,6 +28,20 @@ type Configuration struct {
 	Audience StringList `json:"audience"`
 	// Allowed OIDC issuers
 	Issuers map[string]*Issuer `json:"issuers"`
+	// Named variable provider instances
+	Providers map[string]*ProviderConfig `json:"providers"`
+	// Named Kubernetes cluster connections
+	Clusters map[string]*KubernetesCluster `json:"clusters"`
+	// Path of the file recording issued SSH certificates, enables their revocation
+	SSHStore string `json:"ssh_store" yaml:"ssh_store"`
+	// Keys used to sign the tokens minted by the policy
+	Signing *Signing `json:"signing,omitempty"`
+	// Limits of the cache of builtin results
+	Cache *Cache `json:"cache,omitempty"`
+	// Destinations of the HTTP requests sent by the policy, unrestricted when unset
+	Egress []EgressRule `json:"egress,omitempty"`
+	// Limits of each policy evaluation
+	Limits *Limits `json:"limits,omitempty"`
 	// Supported JWT token algorithms
 	Algorithms []jose.SignatureAlgorithm `json:"algorithms"`
 	// IP address and port to listen on
@@ -64,6 +78,21 @@ func ReadConfiguration(path string) (*Configuration, error) {
 		issuer.Name = name
 	}
 
+	for name, provider := range c.Providers {
+		if provider == nil {
+			return nil, fmt.Errorf("provider %s: missing type", name)
+		}
+		provider.Name = name
+	}
+
+	for name, cluster := range c.Clusters {
+		if cluster == nil {
+			cluster = &KubernetesCluster{}
+			c.Clusters[name] = cluster
+		}
+		cluster.Name = name
+	}
+
 	if len(c.Listen) == 0 {
 		port := os.Getenv("PORT")
 		if port == "" {
@@ -83,6 +83,23 @@ func TestReadConfiguration(t *testing.T) {
 						JWKS:   &JWKS{jwks.Keys},
 					},
 				},
+				Providers: map[string]*ProviderConfig{
+					"plugin": {
+						Name: "plugin",
+						Type: "exec",
+						Options: map[string]any{
+							"command": "/usr/local/bin/plugin",
+							"timeout": "5s",
+						},
+					},
+				},
+				Clusters: map[string]*KubernetesCluster{
+					"staging": {
+						Name:       "staging",
+						Kubeconfig: "/etc/ezoidc/staging.kubeconfig",
+						Context:    "staging",
+					},
+				},
 			},
 		},
 	}
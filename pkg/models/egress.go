@@ -0,0 +1,10 @@
+package models
+
+// Destination that the policy may send HTTP requests to
+type EgressRule struct {
+	// Host name or IP address, `*.example.com` matches subdomains and `*` any host.
+	// A port can be set with host:port, otherwise only the default port of the scheme is allowed.
+	Host string `json:"host"`
+	// Allowed URL schemes, defaults to https
+	Schemes []string `json:"schemes,omitempty"`
+}
@@ -19,6 +19,20 @@ type Issuer struct {
 	JWKSURI string `json:"jwks_uri,omitempty" yaml:"jwks_uri,omitempty"`
 	// The content of the JWKS
 	JWKS *JWKS `json:"jwks,omitempty"`
+	// Name of the Kubernetes cluster to discover the issuer and JWKS from
+	Cluster string `json:"cluster,omitempty"`
+	// Reject tokens used more than the allowed number of times
+	Replay *ReplayProtection `json:"replay,omitempty"`
+}
+
+// Uses of the tokens of an issuer, identified by their jti or their hash
+type ReplayProtection struct {
+	// Number of times a token can be used before it expires, defaults to 1
+	MaxUses int `json:"max_uses,omitempty" yaml:"max_uses"`
+	// Maximum number of recorded tokens, defaults to 10000
+	MaxEntries int `json:"max_entries,omitempty" yaml:"max_entries"`
+	// File snapshotting the uses across restarts of a single server
+	Path string `json:"path,omitempty"`
 }
 
 // Attempt to resolve the issuer's JWKS using OIDC Discovery or the provided JWKS URI
@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+const (
+	ReasonLimitTimeout       = "limit:timeout"
+	ReasonLimitHTTPRequests  = "limit:http_requests"
+	ReasonLimitBuiltinErrors = "limit:builtin_errors"
+	ReasonLimitResponseSize  = "limit:response_size"
+)
+
+// Limits of a single policy evaluation, unlimited when zero
+type Limits struct {
+	// Wall-clock duration of an evaluation, including its HTTP requests
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Maximum number of HTTP requests sent by http.send and builtins, including redirects
+	MaxHTTPRequests int `json:"max_http_requests,omitempty" yaml:"max_http_requests"`
+	// Maximum number of errors raised by http.send and ezoidc builtins
+	MaxBuiltinErrors int `json:"max_builtin_errors,omitempty" yaml:"max_builtin_errors"`
+	// Maximum size in bytes of an HTTP response body
+	MaxResponseSize int64 `json:"max_response_size,omitempty" yaml:"max_response_size"`
+}
+
+// Evaluation aborted for exceeding one of its limits
+type LimitError struct {
+	Reason  string
+	Message string
+}
+
+func (e *LimitError) Error() string {
+	return e.Message
+}
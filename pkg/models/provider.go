@@ -0,0 +1,33 @@
+package models
+
+import (
+	"bytes"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Named variable provider instance
+type ProviderConfig struct {
+	// The name of the provider to be used in variable values
+	Name string `json:"name" yaml:"-"`
+	// The type of provider
+	Type string `json:"type"`
+	// Options specific to the type of provider
+	Options map[string]any `json:"options" yaml:",inline"`
+}
+
+// Decode the provider options, rejecting unknown fields
+func (p *ProviderConfig) Decode(out any) error {
+	if len(p.Options) == 0 {
+		return nil
+	}
+
+	data, err := yaml.Marshal(p.Options)
+	if err != nil {
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	return dec.Decode(out)
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// Keys used to sign the tokens minted by the policy, making the server an OIDC issuer
+type Signing struct {
+	// Public URL of the server, used as the `iss` claim and to serve the discovery document
+	Issuer string `json:"issuer"`
+	// Signature algorithm, inferred from the key files and defaults to RS256 for generated keys
+	Algorithm jose.SignatureAlgorithm `json:"algorithm,omitempty"`
+	// Private keys read from files, the first one signs and the others are only published
+	Keys []SigningKey `json:"keys,omitempty"`
+	// Rotation period of the keys generated when no key files are configured, defaults to 24h
+	RotationPeriod time.Duration `json:"rotation_period,omitempty" yaml:"rotation_period"`
+}
+
+type SigningKey struct {
+	// Path of the PEM encoded private key
+	Path string `json:"path"`
+	// Key ID, defaults to the RFC 7638 thumbprint of the key
+	ID string `json:"id,omitempty"`
+}
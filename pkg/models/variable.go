@@ -3,6 +3,7 @@ package models
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
@@ -12,6 +13,8 @@ type Variable struct {
 	Value  VariableValue `json:"value,omitempty"`
 	Export string        `json:"export,omitempty"`
 	Redact *bool         `json:"redact,omitempty"`
+	// Name of the variable this variable was expanded from
+	Parent string `json:"-"`
 }
 
 type VariableValue struct {
@@ -66,3 +69,28 @@ func (v Variable) Resolve(value string) Variable {
 	v.Value.ID = ""
 	return v
 }
+
+// Create a resolved variable from one of the values of an expanded variable.
+// Its name is suffixed with the key, and its export is prefixed by the parent's export.
+func (v Variable) Expand(key string, value string) Variable {
+	child := v.Resolve(value)
+	child.Name = v.Name + "/" + key
+	child.Parent = v.Name
+	if v.Export != "" {
+		child.Export = v.Export + EnvName(key)
+	}
+	return child
+}
+
+// Convert a key to an environment variable name
+func EnvName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
@@ -23,3 +23,27 @@ func TestVariableResolve(t *testing.T) {
 	assert.Equal(t, v.Redact, v2.Redact)
 	assert.Equal(t, v2.Value, VariableValue{String: "bar"})
 }
+
+func TestVariableExpand(t *testing.T) {
+	v := Variable{
+		Name: "db",
+		Value: VariableValue{
+			Provider: "kubernetes.secret",
+			ID:       "default/db/*",
+		},
+		Export: "DB_",
+		Redact: &true_,
+	}
+	child := v.Expand("tls.crt", "cert")
+
+	assert.Equal(t, Variable{
+		Name:   "db/tls.crt",
+		Value:  VariableValue{String: "cert"},
+		Export: "DB_TLS_CRT",
+		Redact: &true_,
+		Parent: "db",
+	}, child)
+
+	v.Export = ""
+	assert.Equal(t, "", v.Expand("key", "value").Export)
+}
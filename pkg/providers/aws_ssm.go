@@ -2,29 +2,80 @@ package providers
 
 import (
 	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/ezoidc/ezoidc/pkg/models"
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// Name expanded variables after the parameter path relative to the requested path
+	SSMNamingRelative = "relative"
+	// Name expanded variables after the last segment of the parameter path
+	SSMNamingBasename = "basename"
+	// Name expanded variables after the full parameter path
+	SSMNamingFull = "full"
+)
+
 type SSMProvider struct {
-	Client SSMClient
+	Client SSMClient `yaml:"-"`
+	// Naming of the variables expanded from a path: relative, basename or full
+	Naming string `yaml:"naming"`
+	// Whether to include parameters nested below the path, defaults to true
+	Recursive *bool `yaml:"recursive"`
+	// Expand each item of StringList parameters into its own variable when
+	// expanding a path, parameters read by name keep their comma separated value
+	SplitStringLists bool `yaml:"split_string_lists"`
+	// Type of the parameters created by writes, defaults to SecureString
+	WriteType string `yaml:"write_type"`
+	// KMS key used to encrypt SecureString parameters, defaults to the AWS managed key
+	WriteKeyID string `yaml:"write_key_id"`
 }
 
 type SSMClient interface {
 	GetParameters(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error)
+	GetParametersByPath(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error)
+	PutParameter(ctx context.Context, params *ssm.PutParameterInput, optFns ...func(*ssm.Options)) (*ssm.PutParameterOutput, error)
 }
 
 func NewSSMProvider() *SSMProvider {
 	return &SSMProvider{}
 }
 
+func NewSSMProviderFromConfig(config *models.ProviderConfig) (VariableProvider, error) {
+	p := &SSMProvider{}
+	if err := config.Decode(p); err != nil {
+		return nil, err
+	}
+
+	switch p.Naming {
+	case "", SSMNamingRelative, SSMNamingBasename, SSMNamingFull:
+	default:
+		return nil, fmt.Errorf("unknown naming %q", p.Naming)
+	}
+
+	switch types.ParameterType(p.WriteType) {
+	case "", types.ParameterTypeString, types.ParameterTypeStringList, types.ParameterTypeSecureString:
+	default:
+		return nil, fmt.Errorf("unknown write_type %q", p.WriteType)
+	}
+
+	return p, nil
+}
+
 var (
 	true_     = true
 	batchSize = 10
 )
 
+// Parameters are read by name, optionally suffixed by a :version or :label selector
 func (p *SSMProvider) Read(ctx context.Context, variables map[string]string) (map[string]string, error) {
 	err := p.configure(ctx)
 	if err != nil {
@@ -33,7 +84,9 @@ func (p *SSMProvider) Read(ctx context.Context, variables map[string]string) (ma
 	params := []string{}
 	paramNames := map[string][]string{}
 	for name, param := range variables {
-		params = append(params, param)
+		if _, ok := paramNames[param]; !ok {
+			params = append(params, param)
+		}
 		paramNames[param] = append(paramNames[param], name)
 	}
 
@@ -57,7 +110,9 @@ func (p *SSMProvider) Read(ctx context.Context, variables map[string]string) (ma
 		}
 		for _, param := range resp.Parameters {
 			if param.Name != nil && param.Value != nil {
-				for _, name := range paramNames[*param.Name] {
+				// the selector is returned separately from the name
+				id := *param.Name + aws.ToString(param.Selector)
+				for _, name := range paramNames[id] {
 					result[name] = *param.Value
 				}
 			}
@@ -67,6 +122,118 @@ func (p *SSMProvider) Read(ctx context.Context, variables map[string]string) (ma
 	return result, nil
 }
 
+// Paths ending with /* are expanded into one variable per parameter
+func (p *SSMProvider) Expands(id string) bool {
+	return strings.HasSuffix(id, "/*")
+}
+
+func (p *SSMProvider) Expand(ctx context.Context, variables map[string]string) (map[string]map[string]string, error) {
+	err := p.configure(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byPath := map[string]map[string]string{}
+	result := map[string]map[string]string{}
+	for name, id := range variables {
+		prefix := strings.TrimSuffix(id, "*")
+		values, ok := byPath[prefix]
+		if !ok {
+			values, err = p.getParametersByPath(ctx, prefix)
+			if err != nil {
+				log.Warn().Err(err).Str("path", prefix).Msg("failed to get ssm parameters by path")
+				continue
+			}
+			byPath[prefix] = values
+		}
+		result[name] = values
+	}
+
+	return result, nil
+}
+
+func (p *SSMProvider) getParametersByPath(ctx context.Context, prefix string) (map[string]string, error) {
+	values := map[string]string{}
+	input := &ssm.GetParametersByPathInput{
+		Path:           aws.String(strings.TrimSuffix(prefix, "/")),
+		Recursive:      aws.Bool(p.Recursive == nil || *p.Recursive),
+		WithDecryption: &true_,
+	}
+	if *input.Path == "" {
+		input.Path = aws.String("/")
+	}
+
+	for {
+		resp, err := p.Client.GetParametersByPath(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		log.Debug().Str("path", *input.Path).Int("parameters", len(resp.Parameters)).Msg("get ssm parameters by path")
+
+		for _, param := range resp.Parameters {
+			if param.Name == nil || param.Value == nil {
+				continue
+			}
+			key := p.key(prefix, *param.Name)
+			if p.SplitStringLists && param.Type == types.ParameterTypeStringList {
+				for i, item := range strings.Split(*param.Value, ",") {
+					values[key+"/"+strconv.Itoa(i)] = item
+				}
+				continue
+			}
+			values[key] = *param.Value
+		}
+
+		if aws.ToString(resp.NextToken) == "" {
+			return values, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// Name of an expanded variable according to the naming option
+func (p *SSMProvider) key(prefix string, name string) string {
+	switch p.Naming {
+	case SSMNamingBasename:
+		return path.Base(name)
+	case SSMNamingFull:
+		return strings.TrimPrefix(name, "/")
+	}
+	return strings.TrimPrefix(name, prefix)
+}
+
+// Create or overwrite a parameter, selectors cannot be written
+func (p *SSMProvider) Write(ctx context.Context, id string, value string) error {
+	if strings.Contains(id, ":") {
+		return fmt.Errorf("cannot write ssm parameter with a selector: %s", id)
+	}
+
+	err := p.configure(ctx)
+	if err != nil {
+		return err
+	}
+
+	input := &ssm.PutParameterInput{
+		Name:      aws.String(id),
+		Value:     aws.String(value),
+		Overwrite: &true_,
+		Type:      types.ParameterType(p.WriteType),
+	}
+	if input.Type == "" {
+		input.Type = types.ParameterTypeSecureString
+	}
+	if p.WriteKeyID != "" && input.Type == types.ParameterTypeSecureString {
+		input.KeyId = aws.String(p.WriteKeyID)
+	}
+
+	resp, err := p.Client.PutParameter(ctx, input)
+	if err != nil {
+		return err
+	}
+	log.Debug().Str("parameter", id).Int64("version", resp.Version).Msg("put ssm parameter")
+	return nil
+}
+
 func (p *SSMProvider) configure(ctx context.Context) error {
 	if p.Client != nil {
 		return nil
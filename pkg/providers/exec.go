@@ -0,0 +1,198 @@
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/ezoidc/ezoidc/pkg/models"
+	"github.com/rs/zerolog/log"
+)
+
+// Maximum size of the output of an execution
+const execMaxOutputSize = 10 << 20
+
+// Resolves variables using an external executable. The variable names and
+// IDs are written as a JSON object to its stdin, and the resolved values are
+// read as a JSON object from its stdout.
+type ExecProvider struct {
+	// Name of the provider instance
+	Name string `yaml:"-"`
+	// Path to the executable
+	Command string `yaml:"command"`
+	// Arguments given to the executable
+	Args []string `yaml:"args"`
+	// Environment variables given to the executable
+	Env map[string]string `yaml:"env"`
+	// Whether the executable inherits the server's environment variables
+	InheritEnv bool `yaml:"inherit_env"`
+	// Maximum duration of an execution
+	Timeout time.Duration `yaml:"timeout"`
+	// Maximum number of concurrent executions
+	Concurrency int `yaml:"concurrency"`
+
+	semaphore chan struct{}
+}
+
+func NewExecProvider(command string, args ...string) *ExecProvider {
+	p := &ExecProvider{Name: "exec", Command: command, Args: args}
+	p.setDefaults()
+	return p
+}
+
+func NewExecProviderFromConfig(config *models.ProviderConfig) (VariableProvider, error) {
+	p := &ExecProvider{Name: config.Name}
+	if err := config.Decode(p); err != nil {
+		return nil, err
+	}
+
+	if p.Command == "" {
+		return nil, fmt.Errorf("command must not be empty")
+	}
+	if p.Timeout < 0 || p.Concurrency < 0 {
+		return nil, fmt.Errorf("timeout and concurrency must not be negative")
+	}
+
+	p.setDefaults()
+	return p, nil
+}
+
+func (p *ExecProvider) setDefaults() {
+	if p.Timeout == 0 {
+		p.Timeout = 10 * time.Second
+	}
+	if p.Concurrency == 0 {
+		p.Concurrency = 4
+	}
+	p.semaphore = make(chan struct{}, p.Concurrency)
+}
+
+func (p *ExecProvider) Read(ctx context.Context, variables map[string]string) (map[string]string, error) {
+	select {
+	case p.semaphore <- struct{}{}:
+		defer func() { <-p.semaphore }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	execCtx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	input, err := json.Marshal(variables)
+	if err != nil {
+		return nil, err
+	}
+
+	stdout := &limitedBuffer{max: execMaxOutputSize}
+	stderr := p.stderrLogger()
+	defer stderr.Close()
+
+	cmd := exec.CommandContext(execCtx, p.Command, p.Args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.Env = p.environ()
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	err = cmd.Run()
+	log.Debug().Err(err).
+		Str("provider", p.Name).
+		Int("variables", len(variables)).
+		Dur("duration", time.Since(start)).
+		Msg("exec provider")
+
+	if err != nil {
+		if ctx.Err() != nil {
+			// the request ended before the timeout of the provider
+			err = ctx.Err()
+		} else if execCtx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("timed out after %s", p.Timeout)
+		} else if stdout.err != nil {
+			err = stdout.err
+		}
+		log.Warn().Err(err).Str("provider", p.Name).Str("command", p.Command).Msg("exec provider failed")
+		return map[string]string{}, nil
+	}
+
+	var output map[string]string
+	if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+		log.Warn().Err(err).Str("provider", p.Name).Str("command", p.Command).Msg("invalid exec provider output")
+		return map[string]string{}, nil
+	}
+
+	result := map[string]string{}
+	for name := range variables {
+		if value, ok := output[name]; ok {
+			result[name] = value
+		}
+	}
+	return result, nil
+}
+
+func (p *ExecProvider) environ() []string {
+	env := []string{}
+	if p.InheritEnv {
+		env = os.Environ()
+	} else if path, ok := os.LookupEnv("PATH"); ok {
+		env = append(env, "PATH="+path)
+	}
+	for k, v := range p.Env {
+		env = append(env, k+"="+v)
+	}
+	return env
+}
+
+// Log each line written to stderr by the executable, until closed
+func (p *ExecProvider) stderrLogger() io.WriteCloser {
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			log.Warn().Str("provider", p.Name).Str("stderr", scanner.Text()).Msg("exec provider output")
+		}
+		_, _ = io.Copy(io.Discard, r)
+	}()
+	return &stderrLogger{PipeWriter: w, done: done}
+}
+
+// Pipe to the stderr logger, whose lines are all logged once closed
+type stderrLogger struct {
+	*io.PipeWriter
+	done chan struct{}
+}
+
+func (l *stderrLogger) Close() error {
+	err := l.PipeWriter.Close()
+	<-l.done
+	return err
+}
+
+// Buffer failing the writes past its maximum size, which stops the copy of
+// the output and closes the pipe of the executable
+type limitedBuffer struct {
+	buf bytes.Buffer
+	max int
+	// set once the output exceeded the maximum size
+	err error
+}
+
+func (b *limitedBuffer) Write(data []byte) (int, error) {
+	if b.buf.Len()+len(data) > b.max {
+		b.err = fmt.Errorf("output exceeds the maximum size of %d bytes", b.max)
+		return 0, b.err
+	}
+	return b.buf.Write(data)
+}
+
+func (b *limitedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
@@ -2,26 +2,300 @@ package providers
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/ezoidc/ezoidc/pkg/models"
+	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog/log"
 )
 
-type FileProvider struct{}
+const defaultFileMaxSize = 1 << 20
+
+// Reads variable values from files. IDs ending with /* expand into one
+// variable per file of the directory, such as a mounted Kubernetes secret.
+type FileProvider struct {
+	// Cache file contents in memory until a change is detected in their directory
+	Watch bool `yaml:"watch"`
+	// Maximum size of a file in bytes, defaults to 1 MiB
+	MaxSize int64 `yaml:"max_size"`
+	// Allow reading files writable by other users
+	AllowWorldWritable bool `yaml:"allow_world_writable"`
+
+	mu      sync.Mutex
+	watcher *fsnotify.Watcher
+	watched map[string]bool
+	files   map[string]string
+	dirs    map[string][]string
+	// incremented on every change, to avoid caching contents read during a change
+	generation uint64
+	closed     bool
+}
 
 func NewFileProvider() *FileProvider {
 	return &FileProvider{}
 }
 
+func NewFileProviderFromConfig(config *models.ProviderConfig) (VariableProvider, error) {
+	p := &FileProvider{}
+	if err := config.Decode(p); err != nil {
+		return nil, err
+	}
+	if p.MaxSize < 0 {
+		return nil, fmt.Errorf("max_size must not be negative")
+	}
+	return p, nil
+}
+
 func (p *FileProvider) Read(ctx context.Context, variables map[string]string) (map[string]string, error) {
 	result := make(map[string]string)
 	for k, v := range variables {
-		content, err := os.ReadFile(v)
+		content, err := p.readFile(v)
 		if err != nil {
 			log.Warn().Err(err).Str("variable", k).Str("file", v).Msg("failed to read file")
 			continue
 		}
-		result[k] = string(content)
+		result[k] = content
 	}
 	return result, nil
 }
+
+func (p *FileProvider) Expands(id string) bool {
+	return strings.HasSuffix(id, "/*")
+}
+
+func (p *FileProvider) Expand(ctx context.Context, variables map[string]string) (map[string]map[string]string, error) {
+	result := map[string]map[string]string{}
+	for k, v := range variables {
+		dir := filepath.Clean(strings.TrimSuffix(v, "*"))
+		names, err := p.readDir(dir)
+		if err != nil {
+			log.Warn().Err(err).Str("variable", k).Str("directory", dir).Msg("failed to read directory")
+			continue
+		}
+
+		result[k] = map[string]string{}
+		for _, name := range names {
+			file := filepath.Join(dir, name)
+			content, err := p.readFile(file)
+			if err != nil {
+				log.Warn().Err(err).Str("variable", k).Str("file", file).Msg("failed to read file")
+				continue
+			}
+			result[k][name] = content
+		}
+	}
+	return result, nil
+}
+
+func (p *FileProvider) readFile(path string) (string, error) {
+	path = filepath.Clean(path)
+	if p.Watch {
+		p.mu.Lock()
+		content, ok := p.files[path]
+		p.mu.Unlock()
+		if ok {
+			return content, nil
+		}
+	}
+
+	// watch before reading so that changes made in between are not missed
+	generation, cache := p.watch(filepath.Dir(path))
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if err := p.check(info); err != nil {
+		return "", err
+	}
+
+	maxSize := p.maxSize()
+	content, err := io.ReadAll(io.LimitReader(f, maxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if int64(len(content)) > maxSize {
+		return "", fmt.Errorf("file exceeds the maximum size of %d bytes", maxSize)
+	}
+
+	if cache {
+		p.mu.Lock()
+		if p.generation == generation && p.files != nil {
+			p.files[path] = string(content)
+		}
+		p.mu.Unlock()
+	}
+	return string(content), nil
+}
+
+// List the regular files of a directory, skipping hidden files such as
+// the timestamped directories of Kubernetes volumes
+func (p *FileProvider) readDir(dir string) ([]string, error) {
+	if p.Watch {
+		p.mu.Lock()
+		names, ok := p.dirs[dir]
+		p.mu.Unlock()
+		if ok {
+			return names, nil
+		}
+	}
+
+	generation, cache := p.watch(dir)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		// follow symlinks to their target
+		info, err := os.Stat(filepath.Join(dir, entry.Name()))
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+
+	if cache {
+		p.mu.Lock()
+		if p.generation == generation && p.dirs != nil {
+			p.dirs[dir] = names
+		}
+		p.mu.Unlock()
+	}
+	return names, nil
+}
+
+func (p *FileProvider) check(info os.FileInfo) error {
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file")
+	}
+	if info.Size() > p.maxSize() {
+		return fmt.Errorf("file exceeds the maximum size of %d bytes", p.maxSize())
+	}
+	if !p.AllowWorldWritable && info.Mode().Perm()&0o002 != 0 {
+		return fmt.Errorf("file is writable by other users")
+	}
+	return nil
+}
+
+func (p *FileProvider) maxSize() int64 {
+	if p.MaxSize > 0 {
+		return p.MaxSize
+	}
+	return defaultFileMaxSize
+}
+
+// Start watching a directory, returns the current generation and whether
+// its files can be cached
+func (p *FileProvider) watch(dir string) (uint64, bool) {
+	if !p.Watch {
+		return 0, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return 0, false
+	}
+	if p.watched[dir] {
+		return p.generation, true
+	}
+
+	if p.watcher == nil {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to create file watcher")
+			return 0, false
+		}
+		p.watcher = watcher
+		p.watched = map[string]bool{}
+		p.files = map[string]string{}
+		p.dirs = map[string][]string{}
+		go p.run(watcher)
+	}
+
+	if err := p.watcher.Add(dir); err != nil {
+		log.Warn().Err(err).Str("directory", dir).Msg("failed to watch directory")
+		return 0, false
+	}
+	p.watched[dir] = true
+	log.Debug().Str("directory", dir).Msg("watching directory")
+	return p.generation, true
+}
+
+// Stop watching files when the context is done
+func (p *FileProvider) Start(ctx context.Context) error {
+	if p.Watch {
+		go func() {
+			<-ctx.Done()
+			_ = p.Close()
+		}()
+	}
+	return nil
+}
+
+// Stop watching files, which are then read on every request
+func (p *FileProvider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	// reads started before closing must not cache their contents
+	p.generation++
+	if p.watcher == nil {
+		return nil
+	}
+	err := p.watcher.Close()
+	p.watcher = nil
+	p.watched = nil
+	p.files = nil
+	p.dirs = nil
+	return err
+}
+
+// Invalidate the cached files of a directory when any of its entries change,
+// which covers both in-place writes and symlink swaps
+func (p *FileProvider) run(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			dir := filepath.Dir(event.Name)
+			log.Debug().Str("file", event.Name).Str("op", event.Op.String()).Msg("file changed")
+
+			p.mu.Lock()
+			p.generation++
+			delete(p.dirs, dir)
+			for path := range p.files {
+				if filepath.Dir(path) == dir {
+					delete(p.files, path)
+				}
+			}
+			p.mu.Unlock()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Warn().Err(err).Msg("file watcher error")
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ezoidc/ezoidc/pkg/models"
+	"github.com/ezoidc/ezoidc/pkg/static"
+	"github.com/rs/zerolog/log"
+)
+
+// Fetches variable values from a JSON API. The variable ID is appended to
+// the base URL with its path segments escaped, and the value is extracted from the response using a JSON pointer.
+type HTTPProvider struct {
+	// Name of the provider instance
+	Name string `yaml:"-"`
+	// URL prefix of the requests
+	BaseURL string `yaml:"base_url"`
+	// Request headers, values may reference ${env:NAME} or ${file:path}
+	Headers map[string]string `yaml:"headers"`
+	// JSON pointer (RFC 6901) of the value in the response
+	Pointer string `yaml:"pointer"`
+	// URL receiving a JSON array of IDs and returning a JSON object keyed by ID
+	BatchURL string `yaml:"batch_url"`
+	// Duration to cache values for, disabled when zero
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+
+	Client *http.Client `yaml:"-"`
+
+	mu    sync.Mutex
+	cache map[string]httpCacheEntry
+}
+
+// Maximum size of a response body, larger responses are rejected
+const httpMaxResponseSize = 10 << 20
+
+type httpCacheEntry struct {
+	value   string
+	expires time.Time
+}
+
+func NewHTTPProviderFromConfig(config *models.ProviderConfig) (VariableProvider, error) {
+	p := &HTTPProvider{Name: config.Name}
+	if err := config.Decode(p); err != nil {
+		return nil, err
+	}
+
+	if p.BaseURL == "" && p.BatchURL == "" {
+		return nil, fmt.Errorf("base_url or batch_url must not be empty")
+	}
+	if p.Pointer != "" && !strings.HasPrefix(p.Pointer, "/") {
+		return nil, fmt.Errorf("pointer must start with /")
+	}
+
+	return p, nil
+}
+
+func (p *HTTPProvider) Read(ctx context.Context, variables map[string]string) (map[string]string, error) {
+	result := map[string]string{}
+	missing := map[string]bool{}
+	for name, id := range variables {
+		if value, ok := p.cached(id); ok {
+			result[name] = value
+		} else {
+			missing[id] = true
+		}
+	}
+
+	values := map[string]string{}
+	if p.BatchURL != "" && len(missing) > 0 {
+		ids := make([]string, 0, len(missing))
+		for id := range missing {
+			ids = append(ids, id)
+		}
+		batch, err := p.fetchBatch(ctx, ids)
+		if err != nil {
+			log.Warn().Err(err).Str("provider", p.Name).Msg("failed to fetch http batch")
+		}
+		values = batch
+	} else {
+		for id := range missing {
+			value, err := p.fetch(ctx, id)
+			if err != nil {
+				log.Warn().Err(err).Str("provider", p.Name).Str("id", id).Msg("failed to fetch http value")
+				continue
+			}
+			values[id] = value
+		}
+	}
+
+	for id, value := range values {
+		p.store(id, value)
+	}
+
+	for name, id := range variables {
+		if value, ok := values[id]; ok {
+			result[name] = value
+		}
+	}
+
+	return result, nil
+}
+
+func (p *HTTPProvider) fetch(ctx context.Context, id string) (string, error) {
+	path, err := escapeID(id)
+	if err != nil {
+		return "", err
+	}
+
+	var doc any
+	if err := p.do(ctx, "GET", p.BaseURL+path, nil, &doc); err != nil {
+		return "", err
+	}
+	return jsonPointerString(doc, p.Pointer)
+}
+
+func (p *HTTPProvider) fetchBatch(ctx context.Context, ids []string) (map[string]string, error) {
+	body, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs map[string]any
+	if err := p.do(ctx, "POST", p.BatchURL, body, &docs); err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	for _, id := range ids {
+		doc, ok := docs[id]
+		if !ok {
+			log.Warn().Str("provider", p.Name).Str("id", id).Msg("id not found in http batch response")
+			continue
+		}
+		value, err := jsonPointerString(doc, p.Pointer)
+		if err != nil {
+			log.Warn().Err(err).Str("provider", p.Name).Str("id", id).Msg("failed to read http batch value")
+			continue
+		}
+		values[id] = value
+	}
+	return values, nil
+}
+
+func (p *HTTPProvider) do(ctx context.Context, method string, endpoint string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "ezoidc/"+static.Version)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range p.Headers {
+		value, err := expandReferences(v)
+		if err != nil {
+			return fmt.Errorf("header %s: %w", k, err)
+		}
+		req.Header.Set(k, value)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = models.HTTPClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	log.Debug().Str("provider", p.Name).Str("method", method).Str("url", endpoint).Int("status", resp.StatusCode).Msg("http provider")
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, httpMaxResponseSize))
+		return fmt.Errorf("%s %s returned status code %d", method, endpoint, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, httpMaxResponseSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > httpMaxResponseSize {
+		return fmt.Errorf("%s %s returned more than %d bytes", method, endpoint, httpMaxResponseSize)
+	}
+	return json.Unmarshal(data, out)
+}
+
+// Escape the segments of a variable ID appended to the base URL, which must
+// stay under the base URL
+func escapeID(id string) (string, error) {
+	segments := strings.Split(id, "/")
+	for i, segment := range segments {
+		if segment == "." || segment == ".." {
+			return "", fmt.Errorf("invalid id %q", id)
+		}
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+func (p *HTTPProvider) cached(id string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.cache[id]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.value, true
+}
+
+func (p *HTTPProvider) store(id string, value string) {
+	if p.CacheTTL <= 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cache == nil {
+		p.cache = map[string]httpCacheEntry{}
+	}
+	now := time.Now()
+	for k, entry := range p.cache {
+		if now.After(entry.expires) {
+			delete(p.cache, k)
+		}
+	}
+	p.cache[id] = httpCacheEntry{value: value, expires: now.Add(p.CacheTTL)}
+}
+
+// References to the value of an environment variable or file in header values
+var referencePattern = regexp.MustCompile(`\$\{(env|file):([^}]*)\}`)
+
+// Replace ${env:NAME} and ${file:path} references with their value, leaving
+// the rest of the string as is. Fails when a referenced file cannot be read.
+func expandReferences(s string) (string, error) {
+	var err error
+	expanded := referencePattern.ReplaceAllStringFunc(s, func(ref string) string {
+		match := referencePattern.FindStringSubmatch(ref)
+		if match[1] == "env" {
+			return os.Getenv(match[2])
+		}
+		content, readErr := os.ReadFile(match[2])
+		if readErr != nil {
+			if err == nil {
+				err = fmt.Errorf("failed to read file reference: %w", readErr)
+			}
+			return ""
+		}
+		return strings.TrimSpace(string(content))
+	})
+	return expanded, err
+}
+
+// Resolve a JSON pointer (RFC 6901) and format the value as a string
+func jsonPointerString(doc any, pointer string) (string, error) {
+	if pointer != "" {
+		for _, token := range strings.Split(pointer, "/")[1:] {
+			token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+			switch node := doc.(type) {
+			case map[string]any:
+				v, ok := node[token]
+				if !ok {
+					return "", fmt.Errorf("pointer %s not found", pointer)
+				}
+				doc = v
+			case []any:
+				i, err := strconv.Atoi(token)
+				if err != nil || i < 0 || i >= len(node) {
+					return "", fmt.Errorf("pointer %s not found", pointer)
+				}
+				doc = node[i]
+			default:
+				return "", fmt.Errorf("pointer %s not found", pointer)
+			}
+		}
+	}
+
+	if s, ok := doc.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(doc)
+	return string(b), err
+}
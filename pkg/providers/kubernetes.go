@@ -10,8 +10,10 @@ import (
 
 	"github.com/ezoidc/ezoidc/pkg/models"
 	"github.com/go-jose/go-jose/v4"
+	"github.com/rs/zerolog/log"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 const (
@@ -26,8 +28,18 @@ var (
 	kubernetesClientOnce    sync.Once
 	kubernetesClient        *kubernetes.Clientset
 	kubernetesClientErr     error
+
+	kubernetesClustersMu sync.Mutex
+	kubernetesClusters   = map[string]*kubernetesCluster{}
 )
 
+type kubernetesCluster struct {
+	config     *models.KubernetesCluster
+	client     *kubernetes.Clientset
+	restConfig *rest.Config
+	namespace  string
+}
+
 func CurrentKubernetesNamespace() string {
 	kubernetesNamespaceOnce.Do(func() {
 		namespace := strings.TrimSpace(os.Getenv(kubernetesPodNamespaceEnv))
@@ -65,6 +77,96 @@ func CurrentKubernetesClient() (*kubernetes.Clientset, error) {
 	return kubernetesClient, kubernetesClientErr
 }
 
+// Register the named cluster connections
+func ConfigureKubernetesClusters(clusters map[string]*models.KubernetesCluster) {
+	kubernetesClustersMu.Lock()
+	defer kubernetesClustersMu.Unlock()
+
+	kubernetesClusters = map[string]*kubernetesCluster{}
+	for name, cluster := range clusters {
+		kubernetesClusters[name] = &kubernetesCluster{config: cluster}
+	}
+}
+
+// Get the client of a named cluster, or the in-cluster client if the name is empty
+func KubernetesClientForCluster(name string) (*kubernetes.Clientset, error) {
+	if name == "" {
+		return CurrentKubernetesClient()
+	}
+
+	cluster, err := getKubernetesCluster(name)
+	if err != nil {
+		return nil, err
+	}
+	return cluster.client, nil
+}
+
+// Get the connection settings of a named cluster, or the in-cluster settings if the name is empty
+func KubernetesRESTConfigForCluster(name string) (*rest.Config, error) {
+	if name == "" {
+		return rest.InClusterConfig()
+	}
+
+	cluster, err := getKubernetesCluster(name)
+	if err != nil {
+		return nil, err
+	}
+	return cluster.restConfig, nil
+}
+
+// Get the default namespace of a named cluster, or the current namespace if the name is empty
+func KubernetesNamespaceForCluster(name string) string {
+	if name == "" {
+		return CurrentKubernetesNamespace()
+	}
+
+	cluster, err := getKubernetesCluster(name)
+	if err != nil || cluster.namespace == "" {
+		return "default"
+	}
+	return cluster.namespace
+}
+
+func getKubernetesCluster(name string) (*kubernetesCluster, error) {
+	kubernetesClustersMu.Lock()
+	defer kubernetesClustersMu.Unlock()
+
+	cluster, ok := kubernetesClusters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown kubernetes cluster: %s", name)
+	}
+	if cluster.client != nil {
+		return cluster, nil
+	}
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = cluster.config.Kubeconfig
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{
+		CurrentContext: cluster.config.Context,
+	})
+
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubernetes cluster %s: %w", name, err)
+	}
+
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client for kubernetes cluster %s: %w", name, err)
+	}
+
+	namespace := cluster.config.Namespace
+	if namespace == "" {
+		namespace, _, _ = clientConfig.Namespace()
+	}
+
+	log.Debug().Str("cluster", name).Str("host", restConfig.Host).Msg("loaded kubernetes cluster")
+	cluster.client = client
+	cluster.restConfig = restConfig
+	cluster.namespace = namespace
+	return cluster, nil
+}
+
 func ConfigureKubernetesIssuer(ctx context.Context, config *models.Configuration) error {
 	if config == nil || config.Issuers["k8s"] != nil {
 		return nil
@@ -81,6 +183,43 @@ func ConfigureKubernetesIssuer(ctx context.Context, config *models.Configuration
 	return nil
 }
 
+// Discover the issuer URL and JWKS of issuers configured with a cluster
+func ConfigureKubernetesClusterIssuers(ctx context.Context, config *models.Configuration) error {
+	if config == nil {
+		return nil
+	}
+
+	for name, issuer := range config.Issuers {
+		if issuer.Cluster == "" {
+			continue
+		}
+
+		client, err := KubernetesClientForCluster(issuer.Cluster)
+		if err != nil {
+			return fmt.Errorf("issuer %s: %w", name, err)
+		}
+
+		discovered, err := discoverKubernetesIssuer(ctx, client, name)
+		if err != nil {
+			return fmt.Errorf("issuer %s: %w", name, err)
+		}
+
+		if issuer.Issuer == "" {
+			issuer.Issuer = discovered.Issuer
+		}
+		issuer.JWKSURI = discovered.JWKSURI
+		issuer.JWKS = discovered.JWKS
+
+		log.Debug().
+			Str("issuer", issuer.Issuer).
+			Str("cluster", issuer.Cluster).
+			Int("keys", len(issuer.JWKS.Keys)).
+			Msg("loaded jwks of kubernetes cluster issuer")
+	}
+
+	return nil
+}
+
 func DetectKubernetesIssuer(ctx context.Context) (*models.Issuer, error) {
 	if os.Getenv(kubernetesServiceHostEnv) == "" {
 		return nil, nil
@@ -94,6 +233,10 @@ func DetectKubernetesIssuer(ctx context.Context) (*models.Issuer, error) {
 		return nil, err
 	}
 
+	return discoverKubernetesIssuer(ctx, client, "k8s")
+}
+
+func discoverKubernetesIssuer(ctx context.Context, client *kubernetes.Clientset, name string) (*models.Issuer, error) {
 	req := client.RESTClient().Get().AbsPath("/.well-known/openid-configuration")
 	resp, err := req.DoRaw(ctx)
 	if err != nil {
@@ -121,7 +264,7 @@ func DetectKubernetesIssuer(ctx context.Context) (*models.Issuer, error) {
 
 	modelJWKS := models.JWKS(jwks)
 	return &models.Issuer{
-		Name:    "k8s",
+		Name:    name,
 		Issuer:  oidcConfig.Issuer,
 		JWKSURI: oidcConfig.JwksURI,
 		JWKS:    &modelJWKS,
@@ -0,0 +1,109 @@
+package providers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// Maximum duration of the initial synchronization of each namespace
+const kubernetesInformerSyncTimeout = time.Minute
+
+// Options of the informer watching Kubernetes secrets
+type KubernetesInformerConfig struct {
+	// Namespaces to watch, defaults to the provider's namespace
+	Namespaces []string `yaml:"namespaces"`
+	// Only watch secrets matching this label selector
+	LabelSelector string `yaml:"label_selector"`
+	// Interval of full resynchronizations, disabled when zero
+	Resync time.Duration `yaml:"resync"`
+}
+
+// Serves secrets from an in-memory cache kept up to date by watching the
+// configured namespaces, rather than querying the API server on every read.
+type KubernetesSecretsInformer struct {
+	listers  map[string]corelisters.SecretNamespaceLister
+	stop     chan struct{}
+	stopOnce sync.Once
+	client   kubernetes.Interface
+}
+
+// Start watching secrets until the context is done or Stop is called,
+// and wait for the initial synchronization
+func NewKubernetesSecretsInformer(ctx context.Context, client kubernetes.Interface, config *KubernetesInformerConfig) (*KubernetesSecretsInformer, error) {
+	if _, err := labels.Parse(config.LabelSelector); err != nil {
+		return nil, fmt.Errorf("invalid label_selector: %w", err)
+	}
+
+	i := &KubernetesSecretsInformer{
+		listers: map[string]corelisters.SecretNamespaceLister{},
+		stop:    make(chan struct{}),
+		client:  client,
+	}
+	syncCtx, cancel := context.WithTimeout(ctx, kubernetesInformerSyncTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			i.Stop()
+		case <-i.stop:
+		}
+	}()
+
+	for _, namespace := range config.Namespaces {
+		factory := informers.NewSharedInformerFactoryWithOptions(client, config.Resync,
+			informers.WithNamespace(namespace),
+			informers.WithTweakListOptions(func(o *v1.ListOptions) {
+				o.LabelSelector = config.LabelSelector
+			}),
+		)
+		lister := factory.Core().V1().Secrets().Lister()
+		factory.Start(i.stop)
+
+		for informer, synced := range factory.WaitForCacheSync(syncCtx.Done()) {
+			if !synced {
+				i.Stop()
+				return nil, fmt.Errorf("failed to sync %v informer in namespace %s", informer, namespace)
+			}
+		}
+
+		log.Debug().
+			Str("namespace", namespace).
+			Str("label_selector", config.LabelSelector).
+			Msg("synced kubernetes secrets informer")
+		i.listers[namespace] = lister.Secrets(namespace)
+	}
+
+	return i, nil
+}
+
+func (i *KubernetesSecretsInformer) GetSecret(ctx context.Context, namespace string, name string) (map[string][]byte, error) {
+	lister, ok := i.listers[namespace]
+	if !ok {
+		return nil, fmt.Errorf("namespace %s is not watched", namespace)
+	}
+
+	secret, err := lister.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
+
+// Writes go to the API server, the cache is updated by the watch
+func (i *KubernetesSecretsInformer) PatchSecret(ctx context.Context, namespace string, name string, data map[string][]byte) error {
+	return (&KubernetesClient{Client: i.client}).PatchSecret(ctx, namespace, name, data)
+}
+
+// Stop watching secrets
+func (i *KubernetesSecretsInformer) Stop() {
+	i.stopOnce.Do(func() { close(i.stop) })
+}
@@ -2,21 +2,51 @@ package providers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"sync"
 
+	"github.com/ezoidc/ezoidc/pkg/models"
 	"github.com/rs/zerolog/log"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 )
 
+const kubernetesWildcard = "*"
+
 type KubernetesSecretsClient interface {
 	GetSecret(ctx context.Context, namespace string, name string) (map[string][]byte, error)
 }
 
+// Implemented by clients that can update secrets
+type KubernetesSecretsWriter interface {
+	PatchSecret(ctx context.Context, namespace string, name string, data map[string][]byte) error
+}
+
+type KubernetesConfigMapsClient interface {
+	GetConfigMap(ctx context.Context, namespace string, name string) (map[string][]byte, error)
+}
+
 type KubernetesSecretsProvider struct {
-	Client    KubernetesSecretsClient
-	Namespace string
+	Client    KubernetesSecretsClient `yaml:"-"`
+	Namespace string                  `yaml:"namespace"`
+	// Name of the cluster to read from, defaults to the current cluster
+	Cluster string `yaml:"cluster"`
+	// Serve secrets from a watch cache instead of getting them on every read
+	Informer *KubernetesInformerConfig `yaml:"informer"`
+
+	mu sync.Mutex
+}
+
+type KubernetesConfigMapsProvider struct {
+	Client    KubernetesConfigMapsClient `yaml:"-"`
+	Namespace string                     `yaml:"namespace"`
+	// Name of the cluster to read from, defaults to the current cluster
+	Cluster string `yaml:"cluster"`
+
+	mu sync.Mutex
 }
 
 type KubernetesClient struct {
@@ -31,98 +61,315 @@ func (c *KubernetesClient) GetSecret(ctx context.Context, namespace string, name
 	return secret.Data, nil
 }
 
+// Merge the given keys into the data of a secret
+func (c *KubernetesClient) PatchSecret(ctx context.Context, namespace string, name string, data map[string][]byte) error {
+	patch, err := json.Marshal(map[string]any{"data": data})
+	if err != nil {
+		return err
+	}
+	_, err = c.Client.CoreV1().Secrets(namespace).Patch(ctx, name, types.MergePatchType, patch, v1.PatchOptions{})
+	return err
+}
+
+func (c *KubernetesClient) GetConfigMap(ctx context.Context, namespace string, name string) (map[string][]byte, error) {
+	configMap, err := c.Client.CoreV1().ConfigMaps(namespace).Get(ctx, name, v1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	data := map[string][]byte{}
+	for k, v := range configMap.BinaryData {
+		data[k] = v
+	}
+	for k, v := range configMap.Data {
+		data[k] = []byte(v)
+	}
+	return data, nil
+}
+
 func NewKubernetesProvider() *KubernetesSecretsProvider {
 	return &KubernetesSecretsProvider{}
 }
 
+func NewKubernetesConfigMapsProvider() *KubernetesConfigMapsProvider {
+	return &KubernetesConfigMapsProvider{}
+}
+
+func NewKubernetesProviderFromConfig(config *models.ProviderConfig) (VariableProvider, error) {
+	p := &KubernetesSecretsProvider{}
+	if err := config.Decode(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func NewKubernetesConfigMapsProviderFromConfig(config *models.ProviderConfig) (VariableProvider, error) {
+	p := &KubernetesConfigMapsProvider{}
+	if err := config.Decode(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
 func (p *KubernetesSecretsProvider) Read(ctx context.Context, variables map[string]string) (map[string]string, error) {
 	if err := p.configure(); err != nil {
 		return nil, err
 	}
 
-	result := map[string]string{}
-	secretGroups := map[string]map[string]map[string][]string{}
-	for variable, id := range variables {
-		namespace, secret, property, err := p.parseKubernetesID(id)
-		if err != nil {
-			return nil, err
-		}
+	return readKubernetesObjects(ctx, "secret", p.Namespace, variables, p.Client.GetSecret)
+}
 
-		if secretGroups[namespace] == nil {
-			secretGroups[namespace] = map[string]map[string][]string{}
-		}
+func (p *KubernetesSecretsProvider) Expands(id string) bool {
+	return strings.HasSuffix(id, "/"+kubernetesWildcard)
+}
 
-		if secretGroups[namespace][secret] == nil {
-			secretGroups[namespace][secret] = map[string][]string{}
-		}
+func (p *KubernetesSecretsProvider) Expand(ctx context.Context, variables map[string]string) (map[string]map[string]string, error) {
+	if err := p.configure(); err != nil {
+		return nil, err
+	}
 
-		secretGroups[namespace][secret][property] = append(secretGroups[namespace][secret][property], variable)
-	}
-
-	for namespace, secrets := range secretGroups {
-		for secret, properties := range secrets {
-			data, err := p.Client.GetSecret(ctx, namespace, secret)
-			log.Debug().
-				Err(err).
-				Str("namespace", namespace).
-				Str("secret", secret).
-				Msg("get kubernetes secret")
-
-			if err != nil {
-				log.Warn().Err(err).
-					Str("namespace", namespace).
-					Str("secret", secret).
-					Msg("could not get kubernetes secret")
-				continue
-			}
-
-			for property, variables := range properties {
-				for _, variable := range variables {
-					val, ok := data[property]
-					result[variable] = string(val)
-
-					if !ok {
-						log.Warn().
-							Str("namespace", namespace).Str("secret", secret).
-							Str("property", property).Str("variable", variable).
-							Msg("property not found in kubernetes secret")
-					}
-				}
-			}
-		}
+	return expandKubernetesObjects(ctx, "secret", p.Namespace, variables, p.Client.GetSecret)
+}
+
+// Set a key of an existing secret
+func (p *KubernetesSecretsProvider) Write(ctx context.Context, id string, value string) error {
+	if p.Expands(id) {
+		return fmt.Errorf("cannot write kubernetes secret wildcard: %s", id)
+	}
+	if err := p.configure(); err != nil {
+		return err
 	}
 
-	return result, nil
+	writer, ok := p.Client.(KubernetesSecretsWriter)
+	if !ok {
+		return fmt.Errorf("kubernetes secrets client does not support writes")
+	}
+
+	ref, err := parseKubernetesID("secret", id, p.Namespace)
+	if err != nil {
+		return err
+	}
+
+	err = writer.PatchSecret(ctx, ref.namespace, ref.name, map[string][]byte{ref.property: []byte(value)})
+	log.Debug().Err(err).Str("namespace", ref.namespace).Str("secret", ref.name).Str("property", ref.property).Msg("patch kubernetes secret")
+	return err
 }
 
-func (p *KubernetesSecretsProvider) parseKubernetesID(id string) (namespace string, secret string, property string, err error) {
-	parts := strings.Split(id, "/")
-	if len(parts) == 3 {
-		namespace = parts[0]
-		secret = parts[1]
-		property = parts[2]
-	} else if len(parts) == 2 {
-		secret = parts[0]
-		property = parts[1]
-		namespace = p.Namespace
-	} else {
-		err = fmt.Errorf("invalid kubernetes secret id: %s", id)
+// Start the informer, watching secrets until the context is done
+func (p *KubernetesSecretsProvider) Start(ctx context.Context) error {
+	if p.Informer == nil {
+		return nil
 	}
-	return
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.Client != nil {
+		return nil
+	}
+
+	client, err := KubernetesClientForCluster(p.Cluster)
+	if err != nil {
+		return err
+	}
+
+	if p.Namespace == "" {
+		p.Namespace = KubernetesNamespaceForCluster(p.Cluster)
+	}
+	if len(p.Informer.Namespaces) == 0 {
+		p.Informer.Namespaces = []string{p.Namespace}
+	}
+	informer, err := NewKubernetesSecretsInformer(ctx, client, p.Informer)
+	if err != nil {
+		return err
+	}
+	p.Client = informer
+	return nil
 }
 
 func (p *KubernetesSecretsProvider) configure() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.Client != nil {
+		return nil
+	}
+	if p.Informer != nil {
+		return fmt.Errorf("kubernetes secrets informer is not started")
+	}
+
+	client, err := KubernetesClientForCluster(p.Cluster)
+	if err != nil {
+		return err
+	}
+
+	if p.Namespace == "" {
+		p.Namespace = KubernetesNamespaceForCluster(p.Cluster)
+	}
+	p.Client = &KubernetesClient{Client: client}
+
+	return nil
+}
+
+func (p *KubernetesConfigMapsProvider) Read(ctx context.Context, variables map[string]string) (map[string]string, error) {
+	if err := p.configure(); err != nil {
+		return nil, err
+	}
+
+	return readKubernetesObjects(ctx, "configmap", p.Namespace, variables, p.Client.GetConfigMap)
+}
+
+func (p *KubernetesConfigMapsProvider) Expands(id string) bool {
+	return strings.HasSuffix(id, "/"+kubernetesWildcard)
+}
+
+func (p *KubernetesConfigMapsProvider) Expand(ctx context.Context, variables map[string]string) (map[string]map[string]string, error) {
+	if err := p.configure(); err != nil {
+		return nil, err
+	}
+
+	return expandKubernetesObjects(ctx, "configmap", p.Namespace, variables, p.Client.GetConfigMap)
+}
+
+func (p *KubernetesConfigMapsProvider) configure() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	if p.Client != nil {
 		return nil
 	}
 
-	client, err := CurrentKubernetesClient()
+	client, err := KubernetesClientForCluster(p.Cluster)
 	if err != nil {
 		return err
 	}
 
+	if p.Namespace == "" {
+		p.Namespace = KubernetesNamespaceForCluster(p.Cluster)
+	}
 	p.Client = &KubernetesClient{Client: client}
-	p.Namespace = CurrentKubernetesNamespace()
 
 	return nil
 }
+
+type kubernetesGetter func(ctx context.Context, namespace string, name string) (map[string][]byte, error)
+
+type kubernetesRef struct {
+	namespace string
+	name      string
+	property  string
+}
+
+func readKubernetesObjects(ctx context.Context, kind string, namespace string, variables map[string]string, get kubernetesGetter) (map[string]string, error) {
+	refs, objects, err := getKubernetesObjects(ctx, kind, namespace, variables, get)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]string{}
+	for variable, ref := range refs {
+		data, ok := objects[ref.namespace+"/"+ref.name]
+		if !ok {
+			continue
+		}
+
+		val, ok := data[ref.property]
+		result[variable] = string(val)
+
+		if !ok {
+			log.Warn().
+				Str("namespace", ref.namespace).Str(kind, ref.name).
+				Str("property", ref.property).Str("variable", variable).
+				Msgf("property not found in kubernetes %s", kind)
+		}
+	}
+
+	return result, nil
+}
+
+func expandKubernetesObjects(ctx context.Context, kind string, namespace string, variables map[string]string, get kubernetesGetter) (map[string]map[string]string, error) {
+	refs, objects, err := getKubernetesObjects(ctx, kind, namespace, variables, get)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]map[string]string{}
+	for variable, ref := range refs {
+		data, ok := objects[ref.namespace+"/"+ref.name]
+		if !ok {
+			continue
+		}
+
+		result[variable] = map[string]string{}
+		for property, val := range data {
+			result[variable][property] = string(val)
+		}
+	}
+
+	return result, nil
+}
+
+// Fetch each referenced object once, keyed by namespace and name
+func getKubernetesObjects(
+	ctx context.Context,
+	kind string,
+	defaultNamespace string,
+	variables map[string]string,
+	get kubernetesGetter,
+) (map[string]kubernetesRef, map[string]map[string][]byte, error) {
+	refs := map[string]kubernetesRef{}
+	for variable, id := range variables {
+		ref, err := parseKubernetesID(kind, id, defaultNamespace)
+		if err != nil {
+			return nil, nil, err
+		}
+		refs[variable] = ref
+	}
+
+	objects := map[string]map[string][]byte{}
+	failed := map[string]bool{}
+	for _, ref := range refs {
+		key := ref.namespace + "/" + ref.name
+		if _, ok := objects[key]; ok || failed[key] {
+			continue
+		}
+
+		data, err := get(ctx, ref.namespace, ref.name)
+		log.Debug().
+			Err(err).
+			Str("namespace", ref.namespace).
+			Str(kind, ref.name).
+			Msgf("get kubernetes %s", kind)
+
+		if err != nil {
+			log.Warn().Err(err).
+				Str("namespace", ref.namespace).
+				Str(kind, ref.name).
+				Msgf("could not get kubernetes %s", kind)
+			failed[key] = true
+			continue
+		}
+
+		if data == nil {
+			data = map[string][]byte{}
+		}
+		objects[key] = data
+	}
+
+	return refs, objects, nil
+}
+
+func parseKubernetesID(kind string, id string, defaultNamespace string) (ref kubernetesRef, err error) {
+	parts := strings.Split(id, "/")
+	if len(parts) == 3 {
+		ref.namespace = parts[0]
+		ref.name = parts[1]
+		ref.property = parts[2]
+	} else if len(parts) == 2 {
+		ref.name = parts[0]
+		ref.property = parts[1]
+		ref.namespace = defaultNamespace
+	} else {
+		err = fmt.Errorf("invalid kubernetes %s id: %s", kind, id)
+	}
+	return
+}
@@ -2,6 +2,7 @@ package providers
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/ezoidc/ezoidc/pkg/models"
 	"github.com/rs/zerolog/log"
@@ -11,6 +12,41 @@ type VariableProvider interface {
 	Read(ctx context.Context, variables map[string]string) (map[string]string, error)
 }
 
+// Implemented by providers that can resolve a variable into multiple values,
+// such as every key of a Kubernetes secret
+type VariableExpander interface {
+	// Whether the ID refers to multiple values
+	Expands(id string) bool
+	// Read the values of each variable, keyed by variable name and then by key
+	Expand(ctx context.Context, variables map[string]string) (map[string]map[string]string, error)
+}
+
+// Implemented by providers that can update the value of a variable
+type VariableWriter interface {
+	Write(ctx context.Context, id string, value string) error
+}
+
+// Implemented by providers running in the background, such as watches. They
+// are started when the resolver is configured and stop when the context is done.
+type VariableStarter interface {
+	Start(ctx context.Context) error
+}
+
+// Create a provider instance from its configuration
+type ProviderFactory func(config *models.ProviderConfig) (VariableProvider, error)
+
+// Provider types that can be instantiated from the configuration
+var ProviderTypes = map[string]ProviderFactory{
+	"exec": NewExecProviderFromConfig,
+	"file": NewFileProviderFromConfig,
+	"http": NewHTTPProviderFromConfig,
+
+	"aws.ssm": NewSSMProviderFromConfig,
+
+	"kubernetes.secret":    NewKubernetesProviderFromConfig,
+	"kubernetes.configmap": NewKubernetesConfigMapsProviderFromConfig,
+}
+
 type Resolver struct {
 	providers map[string]VariableProvider
 }
@@ -27,6 +63,8 @@ func (r *Resolver) WithDefaultProviders() *Resolver {
 	r.Add("file", NewFileProvider())
 	r.Add("aws.ssm", NewSSMProvider())
 	r.Add("kubernetes.secret", NewKubernetesProvider())
+	r.Add("kubernetes.configmap", NewKubernetesConfigMapsProvider())
+	r.Add("sops", NewSopsProvider())
 	return r
 }
 
@@ -34,12 +72,38 @@ func (r *Resolver) Add(id string, provider VariableProvider) {
 	r.providers[id] = provider
 }
 
+// Add the provider instances defined in the configuration and start them
+// for the lifetime of the context
+func (r *Resolver) Configure(ctx context.Context, configs map[string]*models.ProviderConfig) error {
+	for name, config := range configs {
+		config.Name = name
+		factory, ok := ProviderTypes[config.Type]
+		if !ok {
+			return fmt.Errorf("provider %s: unknown type %q", name, config.Type)
+		}
+
+		provider, err := factory(config)
+		if err != nil {
+			return fmt.Errorf("provider %s: %w", name, err)
+		}
+		if starter, ok := provider.(VariableStarter); ok {
+			if err := starter.Start(ctx); err != nil {
+				return fmt.Errorf("provider %s: %w", name, err)
+			}
+		}
+
+		r.Add(name, provider)
+	}
+	return nil
+}
+
 func (r *Resolver) ForVariable(v models.Variable) (VariableProvider, string) {
 	return r.providers[v.Value.Provider], v.Value.ID
 }
 
 func (r *Resolver) Resolve(ctx context.Context, variables []models.Variable) ([]models.Variable, error) {
 	byProvider := map[VariableProvider]map[string]string{}
+	byExpander := map[VariableExpander]map[string]string{}
 	byName := map[string]models.Variable{}
 
 	for _, v := range variables {
@@ -52,12 +116,20 @@ func (r *Resolver) Resolve(ctx context.Context, variables []models.Variable) ([]
 			continue
 		}
 
+		byName[v.Name] = v
+		if expander, ok := provider.(VariableExpander); ok && expander.Expands(id) {
+			if byExpander[expander] == nil {
+				byExpander[expander] = map[string]string{}
+			}
+			byExpander[expander][v.Name] = id
+			continue
+		}
+
 		if byProvider[provider] == nil {
 			byProvider[provider] = map[string]string{}
 		}
 
 		byProvider[provider][v.Name] = id
-		byName[v.Name] = v
 	}
 
 	resolved := make([]models.Variable, 0, len(variables))
@@ -76,5 +148,18 @@ func (r *Resolver) Resolve(ctx context.Context, variables []models.Variable) ([]
 		}
 	}
 
+	for expander, kv := range byExpander {
+		values, err := expander.Expand(ctx, kv)
+		if err != nil {
+			return nil, err
+		}
+
+		for name, children := range values {
+			for key, value := range children {
+				resolved = append(resolved, byName[name].Expand(key, value))
+			}
+		}
+	}
+
 	return resolved, nil
 }
@@ -1,18 +1,31 @@
 package providers
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
-
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+
+	"filippo.io/age"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
 	"github.com/ezoidc/ezoidc/pkg/models"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 func init() {
@@ -50,6 +63,85 @@ func (c *MockSSMClient) GetParameters(ctx context.Context, params *ssm.GetParame
 	}, nil
 }
 
+func (c *MockSSMClient) GetParametersByPath(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+	return &ssm.GetParametersByPathOutput{}, nil
+}
+
+func (c *MockSSMClient) PutParameter(ctx context.Context, params *ssm.PutParameterInput, optFns ...func(*ssm.Options)) (*ssm.PutParameterOutput, error) {
+	return &ssm.PutParameterOutput{}, nil
+}
+
+// Serves parameters by name, selector and path, one parameter per page.
+// The Selector field of the parameters holds their label.
+type MockSSMParametersClient struct {
+	Parameters []types.Parameter
+}
+
+func (c *MockSSMParametersClient) GetParameters(ctx context.Context, params *ssm.GetParametersInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersOutput, error) {
+	output := &ssm.GetParametersOutput{}
+	for _, id := range params.Names {
+		name, selector, _ := strings.Cut(id, ":")
+		found := false
+		for _, param := range c.Parameters {
+			label := param.Selector != nil && *param.Selector == ":"+selector
+			if *param.Name == name && (selector == "" || label || strconv.FormatInt(param.Version, 10) == selector) {
+				param.Selector = nil
+				if selector != "" {
+					param.Selector = aws.String(":" + selector)
+				}
+				output.Parameters = append(output.Parameters, param)
+				found = true
+				break
+			}
+		}
+		if !found {
+			output.InvalidParameters = append(output.InvalidParameters, id)
+		}
+	}
+	return output, nil
+}
+
+func (c *MockSSMParametersClient) GetParametersByPath(ctx context.Context, params *ssm.GetParametersByPathInput, optFns ...func(*ssm.Options)) (*ssm.GetParametersByPathOutput, error) {
+	matches := []types.Parameter{}
+	for _, param := range c.Parameters {
+		rest, ok := strings.CutPrefix(*param.Name, strings.TrimSuffix(*params.Path, "/")+"/")
+		if ok && (*params.Recursive || !strings.Contains(rest, "/")) {
+			matches = append(matches, param)
+		}
+	}
+
+	start := 0
+	if params.NextToken != nil {
+		start, _ = strconv.Atoi(*params.NextToken)
+	}
+	output := &ssm.GetParametersByPathOutput{}
+	if start < len(matches) {
+		output.Parameters = matches[start : start+1]
+	}
+	if start+1 < len(matches) {
+		output.NextToken = aws.String(strconv.Itoa(start + 1))
+	}
+	return output, nil
+}
+
+func (c *MockSSMParametersClient) PutParameter(ctx context.Context, params *ssm.PutParameterInput, optFns ...func(*ssm.Options)) (*ssm.PutParameterOutput, error) {
+	version := int64(1)
+	for i, param := range c.Parameters {
+		if *param.Name == *params.Name {
+			version = param.Version + 1
+			c.Parameters = append(c.Parameters[:i], c.Parameters[i+1:]...)
+			break
+		}
+	}
+	c.Parameters = append(c.Parameters, types.Parameter{
+		Name:    params.Name,
+		Value:   params.Value,
+		Type:    params.Type,
+		Version: version,
+	})
+	return &ssm.PutParameterOutput{Version: version}, nil
+}
+
 type MockKubernetesClient struct{}
 
 func (c *MockKubernetesClient) GetSecret(ctx context.Context, namespace string, name string) (map[string][]byte, error) {
@@ -74,6 +166,16 @@ func (c *MockKubernetesClient) GetSecret(ctx context.Context, namespace string,
 	return secrets[namespace][name], nil
 }
 
+func (c *MockKubernetesClient) GetConfigMap(ctx context.Context, namespace string, name string) (map[string][]byte, error) {
+	if namespace != "default" || name != "config" {
+		return nil, fmt.Errorf("configmap not found")
+	}
+	return map[string][]byte{
+		"host": []byte("db.local"),
+		"port": []byte("5432"),
+	}, nil
+}
+
 func TestResolverDefault(t *testing.T) {
 	r := NewResolver()
 	r.WithDefaultProviders()
@@ -84,6 +186,10 @@ func TestResolverDefault(t *testing.T) {
 		Client:    &MockKubernetesClient{},
 		Namespace: "default",
 	})
+	r.Add("kubernetes.configmap", &KubernetesConfigMapsProvider{
+		Client:    &MockKubernetesClient{},
+		Namespace: "default",
+	})
 
 	envId := "envvar"
 	os.Setenv(envId, "value")
@@ -153,6 +259,35 @@ func TestResolverDefault(t *testing.T) {
 				ID:       "namespace/secret/.notfound",
 			},
 		},
+		{
+			Name: "k8s-wildcard",
+			Value: models.VariableValue{
+				Provider: "kubernetes.secret",
+				ID:       "namespace/secret/*",
+			},
+			Export: "SECRET_",
+		},
+		{
+			Name: "k8s-wildcard-notfound",
+			Value: models.VariableValue{
+				Provider: "kubernetes.secret",
+				ID:       "namespace/notfound/*",
+			},
+		},
+		{
+			Name: "k8s-configmap",
+			Value: models.VariableValue{
+				Provider: "kubernetes.configmap",
+				ID:       "config/host",
+			},
+		},
+		{
+			Name: "k8s-configmap-wildcard",
+			Value: models.VariableValue{
+				Provider: "kubernetes.configmap",
+				ID:       "default/config/*",
+			},
+		},
 	}
 
 	output, err := r.Resolve(context.TODO(), variables)
@@ -205,6 +340,26 @@ func TestResolverDefault(t *testing.T) {
 			Name:  "k8s-notfoundprop",
 			Value: models.VariableValue{},
 		},
+		{
+			Name:   "k8s-wildcard/.secret",
+			Value:  models.VariableValue{String: "namespacevalue"},
+			Export: "SECRET__SECRET",
+			Parent: "k8s-wildcard",
+		},
+		{
+			Name:  "k8s-configmap",
+			Value: models.VariableValue{String: "db.local"},
+		},
+		{
+			Name:   "k8s-configmap-wildcard/host",
+			Value:  models.VariableValue{String: "db.local"},
+			Parent: "k8s-configmap-wildcard",
+		},
+		{
+			Name:   "k8s-configmap-wildcard/port",
+			Value:  models.VariableValue{String: "5432"},
+			Parent: "k8s-configmap-wildcard",
+		},
 	}, output)
 
 	for _, v := range variables {
@@ -245,3 +400,644 @@ func TestResolverCustom(t *testing.T) {
 		},
 	}, output)
 }
+
+func TestSopsProvider(t *testing.T) {
+	keys, err := os.Open("testdata/sops/key.txt")
+	assert.NoError(t, err)
+	defer keys.Close()
+	identities, err := age.ParseIdentities(keys)
+	assert.NoError(t, err)
+	pgpKeys, err := readPGPKeys("testdata/sops/pgp.asc", "")
+	assert.NoError(t, err)
+
+	p := &SopsProvider{AgeIdentities: identities, PGPKeys: pgpKeys}
+	output, err := p.Read(context.TODO(), map[string]string{
+		"password":  "testdata/sops/secrets.enc.yaml#db.password",
+		"port":      "testdata/sops/secrets.enc.yaml#db.port",
+		"tls":       "testdata/sops/secrets.enc.yaml#db.tls",
+		"token":     "testdata/sops/secrets.enc.yaml#tokens.1",
+		"public":    "testdata/sops/secrets.enc.yaml#public_unencrypted",
+		"db":        "testdata/sops/secrets.enc.yaml#db",
+		"json":      "testdata/sops/secrets.enc.json#api.key",
+		"notfound":  "testdata/sops/secrets.enc.yaml#db.user",
+		"nofile":    "testdata/sops/missing.yaml#key",
+		"plaintext": "testdata/file.txt#key",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"password": "hunter2",
+		"port":     "5432",
+		"tls":      "true",
+		"token":    "second",
+		"public":   "visible",
+		"db":       `{"password":"hunter2","port":5432,"tls":true}`,
+		"json":     "k-123",
+	}, output)
+}
+
+func TestSopsProviderPGP(t *testing.T) {
+	t.Setenv("GNUPGHOME", t.TempDir())
+	pgpKeys, err := readPGPKeys("testdata/sops/pgp.asc", "")
+	assert.NoError(t, err)
+
+	// the first stanza is encrypted to another key
+	p := &SopsProvider{PGPKeys: pgpKeys}
+	output, err := p.Read(context.TODO(), map[string]string{
+		"key": "testdata/sops/pgp.enc.yaml#key",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"key": "pgp-value"}, output)
+}
+
+func TestSopsProviderTampered(t *testing.T) {
+	keys, err := os.Open("testdata/sops/key.txt")
+	assert.NoError(t, err)
+	defer keys.Close()
+	identities, err := age.ParseIdentities(keys)
+	assert.NoError(t, err)
+
+	content, err := os.ReadFile("testdata/sops/secrets.enc.yaml")
+	assert.NoError(t, err)
+	tampered := filepath.Join(t.TempDir(), "secrets.enc.yaml")
+	err = os.WriteFile(tampered, bytes.Replace(content, []byte("visible"), []byte("changed"), 1), 0600)
+	assert.NoError(t, err)
+
+	p := &SopsProvider{AgeIdentities: identities}
+	output, err := p.Read(context.TODO(), map[string]string{
+		"public": tampered + "#public_unencrypted",
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, output)
+
+	_, err = p.decrypt("secrets.enc.yaml", content)
+	assert.NoError(t, err)
+	t.Setenv("SOPS_AGE_KEY_FILE", filepath.Join(t.TempDir(), "missing.txt"))
+	t.Setenv("GNUPGHOME", t.TempDir())
+	_, err = (&SopsProvider{}).decrypt("secrets.enc.yaml", content)
+	assert.ErrorContains(t, err, "Error getting data key")
+}
+
+func TestExecProvider(t *testing.T) {
+	r := NewResolver()
+	err := r.Configure(context.TODO(), map[string]*models.ProviderConfig{
+		"echo": {
+			Type: "exec",
+			Options: map[string]any{
+				"command": "/bin/sh",
+				"args":    []any{"-c", "cat; echo message >&2"},
+				"timeout": "5s",
+			},
+		},
+		"slow": {
+			Type: "exec",
+			Options: map[string]any{
+				"command": "/bin/sh",
+				"args":    []any{"-c", "sleep 5"},
+				"timeout": "100ms",
+			},
+		},
+		"invalid": {
+			Type: "exec",
+			Options: map[string]any{
+				"command": "/bin/sh",
+				"args":    []any{"-c", "echo not json"},
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	variables := []models.Variable{
+		{Name: "a", Value: models.VariableValue{Provider: "echo", ID: "value-a"}},
+		{Name: "b", Value: models.VariableValue{Provider: "echo", ID: "value-b"}},
+		{Name: "c", Value: models.VariableValue{Provider: "slow", ID: "value-c"}},
+		{Name: "d", Value: models.VariableValue{Provider: "invalid", ID: "value-d"}},
+	}
+
+	start := time.Now()
+	output, err := r.Resolve(context.TODO(), variables)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 3*time.Second)
+	assert.ElementsMatch(t, []models.Variable{
+		{Name: "a", Value: models.VariableValue{String: "value-a"}},
+		{Name: "b", Value: models.VariableValue{String: "value-b"}},
+	}, output)
+}
+
+func TestExecProviderErrors(t *testing.T) {
+	buf := &bytes.Buffer{}
+	previous := log.Logger
+	defer func() { log.Logger = previous }()
+	log.Logger = zerolog.New(buf)
+
+	// the output is bounded like the responses of the other providers
+	large := NewExecProvider("/bin/sh", "-c", "head -c 11000000 /dev/zero")
+	output, err := large.Read(context.TODO(), map[string]string{"a": "a"})
+	assert.NoError(t, err)
+	assert.Empty(t, output)
+	assert.Contains(t, buf.String(), "output exceeds the maximum size of 10485760 bytes")
+
+	// the deadline of the request is not reported as the timeout of the provider
+	buf.Reset()
+	slow := NewExecProvider("/bin/sh", "-c", "sleep 5")
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	output, err = slow.Read(ctx, map[string]string{"a": "a"})
+	assert.NoError(t, err)
+	assert.Empty(t, output)
+	assert.Contains(t, buf.String(), `"error":"context deadline exceeded"`)
+	assert.NotContains(t, buf.String(), "timed out after")
+}
+
+func TestConfigureErrors(t *testing.T) {
+	cases := map[string]struct {
+		config   *models.ProviderConfig
+		expected string
+	}{
+		"unknown type": {
+			config:   &models.ProviderConfig{Type: "unknown"},
+			expected: `provider p: unknown type "unknown"`,
+		},
+		"missing command": {
+			config:   &models.ProviderConfig{Type: "exec"},
+			expected: "provider p: command must not be empty",
+		},
+		"unknown option": {
+			config:   &models.ProviderConfig{Type: "exec", Options: map[string]any{"cmd": "true"}},
+			expected: "provider p: yaml: unmarshal errors:\n  line 1: field cmd not found in type providers.ExecProvider",
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := NewResolver().Configure(context.TODO(), map[string]*models.ProviderConfig{"p": c.config})
+			assert.EqualError(t, err, c.expected)
+		})
+	}
+}
+
+func TestHTTPProvider(t *testing.T) {
+	requests := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests++
+		if req.Header.Get("Authorization") != "Bearer token123" {
+			res.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.URL.Path {
+		case "/secrets/db":
+			_, _ = res.Write([]byte(`{"data":{"value":"dbpass"}}`))
+		case "/secrets/obj":
+			_, _ = res.Write([]byte(`{"data":{"value":{"a":1}}}`))
+		case "/secrets/nopointer":
+			_, _ = res.Write([]byte(`{"data":{}}`))
+		case "/secrets/team/a b?":
+			assert.Equal(t, "/secrets/team/a%20b%3F", req.URL.EscapedPath())
+			_, _ = res.Write([]byte(`{"data":{"value":"escaped"}}`))
+		case "/secrets/large":
+			_, _ = res.Write([]byte(`{"data":{"value":"` + strings.Repeat("a", httpMaxResponseSize) + `"}}`))
+		case "/batch":
+			var ids []string
+			_ = json.NewDecoder(req.Body).Decode(&ids)
+			assert.ElementsMatch(t, []string{"one", "two", "missing"}, ids)
+			_, _ = res.Write([]byte(`{"one":{"data":{"value":"1"}},"two":{"data":{"value":"2"}}}`))
+		default:
+			res.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer testServer.Close()
+
+	os.Setenv("HTTP_PROVIDER_TOKEN", "token123")
+	defer os.Unsetenv("HTTP_PROVIDER_TOKEN")
+
+	r := NewResolver()
+	err := r.Configure(context.TODO(), map[string]*models.ProviderConfig{
+		"api": {
+			Type: "http",
+			Options: map[string]any{
+				"base_url":  testServer.URL + "/secrets/",
+				"headers":   map[string]any{"Authorization": "Bearer ${env:HTTP_PROVIDER_TOKEN}"},
+				"pointer":   "/data/value",
+				"cache_ttl": "1m",
+			},
+		},
+		"batch": {
+			Type: "http",
+			Options: map[string]any{
+				"batch_url": testServer.URL + "/batch",
+				"headers":   map[string]any{"Authorization": "Bearer ${env:HTTP_PROVIDER_TOKEN}"},
+				"pointer":   "/data/value",
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	variables := []models.Variable{
+		{Name: "db", Value: models.VariableValue{Provider: "api", ID: "db"}},
+		{Name: "obj", Value: models.VariableValue{Provider: "api", ID: "obj"}},
+		{Name: "nopointer", Value: models.VariableValue{Provider: "api", ID: "nopointer"}},
+		{Name: "notfound", Value: models.VariableValue{Provider: "api", ID: "notfound"}},
+		{Name: "escaped", Value: models.VariableValue{Provider: "api", ID: "team/a b?"}},
+		{Name: "traversal", Value: models.VariableValue{Provider: "api", ID: "../batch"}},
+		{Name: "large", Value: models.VariableValue{Provider: "api", ID: "large"}},
+		{Name: "one", Value: models.VariableValue{Provider: "batch", ID: "one"}},
+		{Name: "two", Value: models.VariableValue{Provider: "batch", ID: "two"}},
+		{Name: "missing", Value: models.VariableValue{Provider: "batch", ID: "missing"}},
+	}
+	expected := []models.Variable{
+		{Name: "db", Value: models.VariableValue{String: "dbpass"}},
+		{Name: "obj", Value: models.VariableValue{String: `{"a":1}`}},
+		{Name: "escaped", Value: models.VariableValue{String: "escaped"}},
+		{Name: "one", Value: models.VariableValue{String: "1"}},
+		{Name: "two", Value: models.VariableValue{String: "2"}},
+	}
+
+	output, err := r.Resolve(context.TODO(), variables)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, expected, output)
+	assert.Equal(t, 7, requests)
+
+	output, err = r.Resolve(context.TODO(), variables)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, expected, output)
+	assert.Equal(t, 11, requests)
+}
+
+func TestHTTPProviderHeaders(t *testing.T) {
+	requests := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		requests++
+		value, _ := json.Marshal(req.Header.Get("Authorization") + " " + req.Header.Get("X-Literal"))
+		_, _ = res.Write([]byte(`{"value":` + string(value) + `}`))
+	}))
+	defer testServer.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("token$1\n"), 0600))
+	t.Setenv("HTTP_PROVIDER_USER", "user")
+
+	provider := func(headers map[string]string) *HTTPProvider {
+		return &HTTPProvider{Name: "api", BaseURL: testServer.URL + "/", Headers: headers, Pointer: "/value"}
+	}
+
+	// only explicit references are replaced, other $ are sent as is
+	output, err := provider(map[string]string{
+		"Authorization": "Basic ${env:HTTP_PROVIDER_USER}:${file:" + tokenFile + "}",
+		"X-Literal":     "abc$def$$ ${other} $HOME",
+	}).Read(context.TODO(), map[string]string{"v": "v"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"v": "Basic user:token$1 abc$def$$ ${other} $HOME"}, output)
+
+	// an unreadable file fails the request rather than sending an empty header
+	p := provider(map[string]string{
+		"Authorization": "Bearer ${file:" + filepath.Join(t.TempDir(), "missing") + "}",
+	})
+	var doc any
+	err = p.do(context.TODO(), "GET", testServer.URL+"/v", nil, &doc)
+	assert.ErrorContains(t, err, "header Authorization: failed to read file reference")
+	output, err = p.Read(context.TODO(), map[string]string{"v": "v"})
+	assert.NoError(t, err)
+	assert.Empty(t, output)
+	assert.Equal(t, 1, requests)
+}
+
+func TestKubernetesSecretsInformer(t *testing.T) {
+	ctx := context.TODO()
+	labeled := map[string]string{"ezoidc.dev/share": "true"}
+	client := fake.NewClientset(
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "db", Labels: labeled},
+			Data:       map[string][]byte{"password": []byte("hunter2")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "unlabeled"},
+			Data:       map[string][]byte{"password": []byte("hidden")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "db", Labels: labeled},
+			Data:       map[string][]byte{"password": []byte("other")},
+		},
+	)
+
+	informer, err := NewKubernetesSecretsInformer(ctx, client, &KubernetesInformerConfig{
+		Namespaces:    []string{"app"},
+		LabelSelector: "ezoidc.dev/share=true",
+	})
+	assert.NoError(t, err)
+	defer informer.Stop()
+
+	p := &KubernetesSecretsProvider{Client: informer, Namespace: "app"}
+	variables := map[string]string{
+		"db":        "db/password",
+		"unlabeled": "app/unlabeled/password",
+		"other":     "other/db/password",
+	}
+
+	output, err := p.Read(ctx, variables)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"db": "hunter2"}, output)
+
+	_, err = client.CoreV1().Secrets("app").Update(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "db", Labels: labeled},
+		Data:       map[string][]byte{"password": []byte("rotated")},
+	}, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		output, err := p.Read(ctx, variables)
+		return err == nil && output["db"] == "rotated"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, action := range client.Actions() {
+		assert.Contains(t, []string{"list", "watch", "update"}, action.GetVerb())
+	}
+
+	_, err = NewKubernetesSecretsInformer(ctx, client, &KubernetesInformerConfig{LabelSelector: "=invalid"})
+	assert.ErrorContains(t, err, "invalid label_selector")
+
+	// stops with the context it was started with
+	lifetime, cancel := context.WithCancel(ctx)
+	stopped, err := NewKubernetesSecretsInformer(lifetime, client, &KubernetesInformerConfig{Namespaces: []string{"app"}})
+	assert.NoError(t, err)
+	cancel()
+	assert.Eventually(t, func() bool {
+		select {
+		case <-stopped.stop:
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+
+	// started when configured rather than on the first read
+	err = NewResolver().Configure(ctx, map[string]*models.ProviderConfig{
+		"watched": {Type: "kubernetes.secret", Options: map[string]any{"cluster": "missing", "informer": map[string]any{}}},
+	})
+	assert.ErrorContains(t, err, "provider watched:")
+}
+
+func TestKubernetesClusters(t *testing.T) {
+	ctx := context.TODO()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_, _ = w.Write([]byte(`{"issuer":"https://remote.cluster.local","jwks_uri":"https://remote.cluster.local/openid/v1/jwks"}`))
+		case "/openid/v1/jwks":
+			_, _ = w.Write([]byte(`{"keys":[{"use":"sig","kty":"RSA","kid":"kid","alg":"RS256","n":"AAAA","e":"AQAB"}]}`))
+		case "/api/v1/namespaces/remote-ns/secrets/db":
+			_, _ = w.Write([]byte(`{"apiVersion":"v1","kind":"Secret","metadata":{"name":"db","namespace":"remote-ns"},"data":{"password":"aHVudGVyMg=="}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	err := os.WriteFile(kubeconfig, []byte(fmt.Sprintf(`
+apiVersion: v1
+kind: Config
+clusters:
+- name: remote
+  cluster:
+    server: %s
+contexts:
+- name: other
+  context:
+    cluster: remote
+- name: remote
+  context:
+    cluster: remote
+    namespace: remote-ns
+current-context: other
+`, server.URL)), 0600)
+	assert.NoError(t, err)
+
+	ConfigureKubernetesClusters(map[string]*models.KubernetesCluster{
+		"remote": {Name: "remote", Kubeconfig: kubeconfig, Context: "remote"},
+	})
+	defer ConfigureKubernetesClusters(nil)
+
+	assert.Equal(t, "remote-ns", KubernetesNamespaceForCluster("remote"))
+	restConfig, err := KubernetesRESTConfigForCluster("remote")
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL, restConfig.Host)
+	_, err = KubernetesClientForCluster("missing")
+	assert.ErrorContains(t, err, "unknown kubernetes cluster: missing")
+
+	config := &models.Configuration{Issuers: map[string]*models.Issuer{
+		"remote": {Cluster: "remote"},
+	}}
+	err = ConfigureKubernetesClusterIssuers(ctx, config)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://remote.cluster.local", config.Issuers["remote"].Issuer)
+	assert.Len(t, config.Issuers["remote"].JWKS.Keys, 1)
+
+	p := &KubernetesSecretsProvider{Cluster: "remote"}
+	output, err := p.Read(ctx, map[string]string{"db": "db/password"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"db": "hunter2"}, output)
+}
+
+func TestSSMProvider(t *testing.T) {
+	ctx := context.TODO()
+	client := &MockSSMParametersClient{Parameters: []types.Parameter{
+		{Name: aws.String("/app/prod/db/password"), Value: aws.String("hunter2"), Version: 2, Selector: aws.String(":current")},
+		{Name: aws.String("/app/prod/api_key"), Value: aws.String("key"), Version: 1},
+		{Name: aws.String("/app/prod/hosts"), Value: aws.String("a.local,b.local"), Type: types.ParameterTypeStringList},
+		{Name: aws.String("/app/dev/api_key"), Value: aws.String("dev"), Version: 1},
+	}}
+
+	p := &SSMProvider{Client: client}
+	output, err := p.Read(ctx, map[string]string{
+		"latest":   "/app/prod/db/password",
+		"version":  "/app/prod/db/password:2",
+		"label":    "/app/prod/db/password:current",
+		"outdated": "/app/prod/db/password:1",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"latest":  "hunter2",
+		"version": "hunter2",
+		"label":   "hunter2",
+	}, output)
+
+	assert.True(t, p.Expands("/app/prod/*"))
+	assert.False(t, p.Expands("/app/prod/api_key"))
+
+	r := NewResolver()
+	r.Add("aws.ssm", p)
+	resolved, err := r.Resolve(ctx, []models.Variable{{
+		Name:   "prod",
+		Export: "PROD_",
+		Value:  models.VariableValue{Provider: "aws.ssm", ID: "/app/prod/*"},
+	}})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []models.Variable{
+		{Name: "prod/db/password", Export: "PROD_DB_PASSWORD", Parent: "prod", Value: models.VariableValue{String: "hunter2"}},
+		{Name: "prod/api_key", Export: "PROD_API_KEY", Parent: "prod", Value: models.VariableValue{String: "key"}},
+		{Name: "prod/hosts", Export: "PROD_HOSTS", Parent: "prod", Value: models.VariableValue{String: "a.local,b.local"}},
+	}, resolved)
+
+	provider, err := NewSSMProviderFromConfig(&models.ProviderConfig{
+		Name: "ssm",
+		Type: "aws.ssm",
+		Options: map[string]any{
+			"naming":             "basename",
+			"recursive":          false,
+			"split_string_lists": true,
+		},
+	})
+	assert.NoError(t, err)
+	p = provider.(*SSMProvider)
+	p.Client = client
+	expanded, err := p.Expand(ctx, map[string]string{"prod": "/app/prod/*"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{
+		"prod": {
+			"api_key": "key",
+			"hosts/0": "a.local",
+			"hosts/1": "b.local",
+		},
+	}, expanded)
+
+	p.Naming = SSMNamingFull
+	expanded, err = p.Expand(ctx, map[string]string{"dev": "/app/dev/*"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{
+		"dev": {"app/dev/api_key": "dev"},
+	}, expanded)
+
+	output, err = p.Read(ctx, map[string]string{"hosts": "/app/prod/hosts"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"hosts": "a.local,b.local"}, output, "string lists read by name are not split")
+
+	_, err = NewSSMProviderFromConfig(&models.ProviderConfig{
+		Type:    "aws.ssm",
+		Options: map[string]any{"naming": "invalid"},
+	})
+	assert.ErrorContains(t, err, "unknown naming")
+}
+
+func TestFileProvider(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	write := func(name string, content string, mode os.FileMode) {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), mode))
+		assert.NoError(t, os.Chmod(filepath.Join(dir, name), mode))
+	}
+	write("small", "value", 0600)
+	write("large", strings.Repeat("x", 64), 0600)
+	write("writable", "value", 0666)
+
+	p := &FileProvider{MaxSize: 32}
+	output, err := p.Read(ctx, map[string]string{
+		"small":    filepath.Join(dir, "small"),
+		"large":    filepath.Join(dir, "large"),
+		"writable": filepath.Join(dir, "writable"),
+		"missing":  filepath.Join(dir, "missing"),
+		"dir":      dir,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"small": "value"}, output)
+
+	p.AllowWorldWritable = true
+	output, err = p.Read(ctx, map[string]string{"writable": filepath.Join(dir, "writable")})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"writable": "value"}, output)
+
+	_, err = NewFileProviderFromConfig(&models.ProviderConfig{Type: "file", Options: map[string]any{"max_size": -1}})
+	assert.ErrorContains(t, err, "max_size must not be negative")
+}
+
+func TestFileProviderWatch(t *testing.T) {
+	ctx := context.TODO()
+
+	// layout of a mounted Kubernetes secret volume, updated by swapping the ..data symlink
+	dir := t.TempDir()
+	swap := func(version string, data map[string]string) {
+		assert.NoError(t, os.Mkdir(filepath.Join(dir, version), 0700))
+		for name, content := range data {
+			assert.NoError(t, os.WriteFile(filepath.Join(dir, version, name), []byte(content), 0600))
+			_ = os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name))
+		}
+		assert.NoError(t, os.Symlink(version, filepath.Join(dir, "..data_tmp")))
+		assert.NoError(t, os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")))
+	}
+	swap("..v1", map[string]string{"username": "admin", "password": "hunter2"})
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	p := &FileProvider{Watch: true}
+	assert.NoError(t, p.Start(watchCtx))
+
+	expanded, err := p.Expand(ctx, map[string]string{"db": dir + "/*"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]string{
+		"db": {"username": "admin", "password": "hunter2"},
+	}, expanded)
+
+	output, err := p.Read(ctx, map[string]string{"password": filepath.Join(dir, "password")})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"password": "hunter2"}, output)
+
+	swap("..v2", map[string]string{"username": "admin", "password": "rotated", "host": "db.local"})
+
+	assert.Eventually(t, func() bool {
+		output, err := p.Read(ctx, map[string]string{"password": filepath.Join(dir, "password")})
+		return err == nil && output["password"] == "rotated"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		expanded, err := p.Expand(ctx, map[string]string{"db": dir + "/*"})
+		return err == nil && len(expanded["db"]) == 3 && expanded["db"]["host"] == "db.local"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// files are no longer watched nor cached once the context is done
+	cancel()
+	assert.Eventually(t, func() bool {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.closed && p.watcher == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "..v2", "password"), []byte("closed"), 0600))
+	output, err = p.Read(ctx, map[string]string{"password": filepath.Join(dir, "password")})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"password": "closed"}, output)
+}
+
+func TestVariableWriters(t *testing.T) {
+	ctx := context.TODO()
+	client := &MockSSMParametersClient{Parameters: []types.Parameter{
+		{Name: aws.String("/app/deploy_key"), Value: aws.String("old"), Version: 1},
+	}}
+
+	ssmProvider := &SSMProvider{Client: client}
+	assert.NoError(t, ssmProvider.Write(ctx, "/app/deploy_key", "new"))
+	assert.NoError(t, ssmProvider.Write(ctx, "/app/created", "value"))
+	assert.ErrorContains(t, ssmProvider.Write(ctx, "/app/deploy_key:1", "new"), "selector")
+
+	output, err := ssmProvider.Read(ctx, map[string]string{
+		"key":     "/app/deploy_key",
+		"version": "/app/deploy_key:2",
+		"created": "/app/created",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"key": "new", "version": "new", "created": "value"}, output)
+	assert.Equal(t, types.ParameterTypeSecureString, client.Parameters[1].Type)
+
+	k8s := fake.NewClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "app", Name: "deploy"},
+		Data:       map[string][]byte{"key": []byte("old"), "other": []byte("kept")},
+	})
+	secrets := &KubernetesSecretsProvider{Client: &KubernetesClient{Client: k8s}, Namespace: "app"}
+	assert.NoError(t, secrets.Write(ctx, "deploy/key", "new"))
+	assert.ErrorContains(t, secrets.Write(ctx, "deploy/*", "new"), "wildcard")
+	assert.Error(t, secrets.Write(ctx, "missing/key", "new"))
+
+	output, err = secrets.Read(ctx, map[string]string{"key": "deploy/key", "other": "app/deploy/other"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"key": "new", "other": "kept"}, output)
+
+	readOnly := &KubernetesSecretsProvider{Client: &MockKubernetesClient{}}
+	assert.ErrorContains(t, readOnly.Write(ctx, "secret/key", "new"), "does not support writes")
+}
@@ -0,0 +1,289 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgparmor "github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/getsops/sops/v3"
+	"github.com/getsops/sops/v3/aes"
+	sopsage "github.com/getsops/sops/v3/age"
+	"github.com/getsops/sops/v3/cmd/sops/formats"
+	"github.com/getsops/sops/v3/config"
+	"github.com/getsops/sops/v3/keyservice"
+	sopsjson "github.com/getsops/sops/v3/stores/json"
+	sopsyaml "github.com/getsops/sops/v3/stores/yaml"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	sopsPGPKeyFileEnv    = "SOPS_PGP_KEY_FILE"
+	sopsPGPPassphraseEnv = "SOPS_PGP_PASSPHRASE"
+)
+
+// Reads values from SOPS encrypted YAML or JSON files. Variable IDs are
+// a file path followed by a dotted key path, such as `secrets.enc.yaml#db.password`.
+type SopsProvider struct {
+	// Age identities used to decrypt the data key
+	AgeIdentities []age.Identity
+	// PGP private keys used to decrypt the data key
+	PGPKeys openpgp.EntityList
+
+	mu         sync.Mutex
+	configured bool
+	files      map[string]*sopsFile
+}
+
+type sopsFile struct {
+	modTime time.Time
+	size    int64
+	data    any
+}
+
+func NewSopsProvider() *SopsProvider {
+	return &SopsProvider{}
+}
+
+func (p *SopsProvider) Read(ctx context.Context, variables map[string]string) (map[string]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.configure(); err != nil {
+		return nil, err
+	}
+
+	result := map[string]string{}
+	for name, id := range variables {
+		path, key, _ := strings.Cut(id, "#")
+		data, err := p.load(path)
+		if err != nil {
+			log.Warn().Err(err).Str("variable", name).Str("file", path).Msg("failed to decrypt sops file")
+			continue
+		}
+
+		value, err := sopsLookup(data, key)
+		if err != nil {
+			log.Warn().Err(err).Str("variable", name).Str("file", path).Str("key", key).Msg("failed to read sops key")
+			continue
+		}
+		result[name] = value
+	}
+
+	return result, nil
+}
+
+// Decrypt the file, or return the cached document if the file is unchanged
+func (p *SopsProvider) load(path string) (any, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.files == nil {
+		p.files = map[string]*sopsFile{}
+	}
+	cached := p.files[path]
+	if cached != nil && cached.modTime.Equal(stat.ModTime()) && cached.size == stat.Size() {
+		return cached.data, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := p.decrypt(path, content)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Str("file", path).Msg("decrypted sops file")
+	p.files[path] = &sopsFile{
+		modTime: stat.ModTime(),
+		size:    stat.Size(),
+		data:    data,
+	}
+	return data, nil
+}
+
+// Decrypt and verify the file with the upstream SOPS stores, as `sops decrypt` does
+func (p *SopsProvider) decrypt(path string, content []byte) (any, error) {
+	var store sops.Store
+	if formats.IsJSONFile(path) {
+		store = sopsjson.NewStore(&config.JSONStoreConfig{})
+	} else {
+		store = sopsyaml.NewStore(&config.YAMLStoreConfig{})
+	}
+
+	tree, err := store.LoadEncryptedFile(content)
+	if err != nil {
+		return nil, err
+	}
+	key, err := tree.Metadata.GetDataKeyWithKeyServices([]keyservice.KeyServiceClient{
+		keyservice.NewCustomLocalClient(&sopsKeyService{provider: p}),
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	cipher := aes.NewCipher()
+	mac, err := tree.Decrypt(key, cipher)
+	if err != nil {
+		return nil, err
+	}
+	originalMAC, err := cipher.Decrypt(tree.Metadata.MessageAuthenticationCode, key, tree.Metadata.LastModified.Format(time.RFC3339))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt sops mac: %w", err)
+	}
+	if originalMAC != mac {
+		return nil, fmt.Errorf("sops mac mismatch")
+	}
+
+	plaintext, err := store.EmitPlainFile(tree.Branches)
+	if err != nil {
+		return nil, err
+	}
+	var data any
+	if err := yaml.Unmarshal(plaintext, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Decrypts the data key with the configured age and PGP keys, then with the
+// default SOPS key sources (environment, GnuPG and cloud KMS)
+type sopsKeyService struct {
+	provider *SopsProvider
+	fallback keyservice.Server
+}
+
+func (s *sopsKeyService) Decrypt(ctx context.Context, req *keyservice.DecryptRequest) (*keyservice.DecryptResponse, error) {
+	switch k := req.Key.KeyType.(type) {
+	case *keyservice.Key_AgeKey:
+		if len(s.provider.AgeIdentities) > 0 {
+			key := &sopsage.MasterKey{Recipient: k.AgeKey.Recipient, EncryptedKey: string(req.Ciphertext)}
+			sopsage.ParsedIdentities(s.provider.AgeIdentities).ApplyToMasterKey(key)
+			plaintext, err := key.Decrypt()
+			if err == nil {
+				return &keyservice.DecryptResponse{Plaintext: plaintext}, nil
+			}
+			log.Debug().Err(err).Str("recipient", k.AgeKey.Recipient).Msg("failed to decrypt sops age key")
+		}
+	case *keyservice.Key_PgpKey:
+		if len(s.provider.PGPKeys) > 0 {
+			plaintext, err := decryptPGP(s.provider.PGPKeys, req.Ciphertext)
+			if err == nil {
+				return &keyservice.DecryptResponse{Plaintext: plaintext}, nil
+			}
+			log.Debug().Err(err).Str("fingerprint", k.PgpKey.Fingerprint).Msg("failed to decrypt sops pgp key")
+		}
+	}
+	return s.fallback.Decrypt(ctx, req)
+}
+
+func (s *sopsKeyService) Encrypt(ctx context.Context, req *keyservice.EncryptRequest) (*keyservice.EncryptResponse, error) {
+	return nil, fmt.Errorf("sops provider does not encrypt")
+}
+
+func decryptPGP(keys openpgp.EntityList, ciphertext []byte) ([]byte, error) {
+	block, err := pgparmor.Decode(bytes.NewReader(ciphertext))
+	if err != nil {
+		return nil, err
+	}
+	md, err := openpgp.ReadMessage(block.Body, keys, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(md.UnverifiedBody)
+}
+
+// Load PGP keys from SOPS_PGP_KEY_FILE unless keys were provided. Age keys
+// are otherwise read by SOPS from SOPS_AGE_KEY, SOPS_AGE_KEY_FILE or SOPS_AGE_KEY_CMD.
+func (p *SopsProvider) configure() error {
+	if p.configured || len(p.AgeIdentities) > 0 || len(p.PGPKeys) > 0 {
+		p.configured = true
+		return nil
+	}
+
+	if pgpKeyFile := os.Getenv(sopsPGPKeyFileEnv); pgpKeyFile != "" {
+		keys, err := readPGPKeys(pgpKeyFile, os.Getenv(sopsPGPPassphraseEnv))
+		if err != nil {
+			return err
+		}
+		p.PGPKeys = keys
+	}
+
+	p.configured = true
+	return nil
+}
+
+func readPGPKeys(path string, passphrase string) (openpgp.EntityList, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse sops pgp keys: %w", err)
+	}
+
+	if passphrase != "" {
+		for _, key := range keys {
+			if err := key.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+				return nil, fmt.Errorf("failed to decrypt sops pgp keys: %w", err)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Find a value by its dotted key path and format it as a string
+func sopsLookup(data any, key string) (string, error) {
+	if key != "" {
+		for _, part := range strings.Split(key, ".") {
+			switch node := data.(type) {
+			case map[string]any:
+				v, ok := node[part]
+				if !ok {
+					return "", fmt.Errorf("key not found: %s", part)
+				}
+				data = v
+			case []any:
+				i, err := strconv.Atoi(part)
+				if err != nil || i < 0 || i >= len(node) {
+					return "", fmt.Errorf("invalid index: %s", part)
+				}
+				data = node[i]
+			default:
+				return "", fmt.Errorf("key not found: %s", part)
+			}
+		}
+	}
+
+	switch v := data.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case map[string]any, []any:
+		b, err := json.Marshal(v)
+		return string(b), err
+	case time.Time:
+		return v.Format(time.RFC3339), nil
+	case nil:
+		return "", nil
+	}
+	return fmt.Sprint(data), nil
+}
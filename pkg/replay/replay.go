@@ -0,0 +1,152 @@
+// Package replay records the uses of tokens to reject their reuse until they expire.
+package replay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const DefaultMaxEntries = 10000
+
+// Returned instead of forgetting tokens that have not expired yet
+var ErrFull = errors.New("replay store is full")
+
+// Uses of a token, kept until the token expires
+type Entry struct {
+	Uses    int       `json:"uses"`
+	Expires time.Time `json:"expires"`
+}
+
+// Token uses of a single process, kept in memory. When Path is set, the uses
+// are loaded from and snapshotted to a JSON file so that they survive restarts.
+// The file is not locked and must not be shared between processes.
+type Store struct {
+	Path       string
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[string]Entry
+	dirty   bool
+
+	writeMu sync.Mutex
+}
+
+func NewStore(path string, maxEntries int) *Store {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	return &Store{Path: path, MaxEntries: maxEntries, entries: map[string]Entry{}}
+}
+
+// Record a use of the token identified by key, false if it was already used maxUses times
+func (s *Store) Use(key string, expires time.Time, maxUses int) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if ok && entry.Uses >= maxUses {
+		return false, nil
+	}
+	if !ok {
+		if len(s.entries) >= s.MaxEntries {
+			s.prune(time.Now())
+		}
+		if len(s.entries) >= s.MaxEntries {
+			return false, ErrFull
+		}
+		entry.Expires = expires
+	}
+	entry.Uses++
+	s.entries[key] = entry
+	s.dirty = true
+
+	return true, nil
+}
+
+func (s *Store) prune(now time.Time) {
+	for k, entry := range s.entries {
+		if !now.Before(entry.Expires) {
+			delete(s.entries, k)
+			s.dirty = true
+		}
+	}
+}
+
+// Load the uses from the snapshot at Path, if any
+func (s *Store) Load() error {
+	if s.Path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entries := map[string]Entry{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("invalid replay store %s: %w", s.Path, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = entries
+	s.prune(time.Now())
+	return nil
+}
+
+// Write the uses to Path if they changed since the last snapshot. The file is
+// replaced atomically so that a crash never leaves a partial snapshot.
+func (s *Store) Snapshot() error {
+	if s.Path == "" {
+		return nil
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	s.prune(time.Now())
+	data, err := json.Marshal(s.entries)
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := s.write(data); err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *Store) write(data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), ".replay-store-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
@@ -0,0 +1,70 @@
+package replay
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	store := NewStore("", 2)
+	expires := time.Now().Add(time.Hour)
+
+	for _, expected := range []bool{true, true, false} {
+		ok, err := store.Use("a", expires, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, ok)
+	}
+
+	ok, err := store.Use("expired", time.Now().Add(-time.Second), 1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// expired entries are pruned to make room
+	ok, err = store.Use("b", expires, 1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// unexpired entries are never forgotten
+	ok, err = store.Use("c", expires.Add(time.Hour), 1)
+	assert.ErrorIs(t, err, ErrFull)
+	assert.False(t, ok)
+	ok, err = store.Use("a", expires, 2)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	ok, err = store.Use("b", expires, 1)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.json")
+	expires := time.Now().Add(time.Hour)
+
+	store := NewStore(path, 0)
+	assert.NoError(t, store.Load())
+	ok, err := store.Use("a", expires, 1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	_, err = store.Use("expired", time.Now().Add(-time.Second), 1)
+	assert.NoError(t, err)
+	assert.NoFileExists(t, path, "uses are only written by snapshots")
+	assert.NoError(t, store.Snapshot())
+
+	restarted := NewStore(path, 0)
+	assert.NoError(t, restarted.Load())
+	assert.Len(t, restarted.entries, 1)
+	ok, err = restarted.Use("a", expires, 1)
+	assert.NoError(t, err)
+	assert.False(t, ok, "uses survive restarts")
+}
+
+func TestStoreInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.json")
+	assert.NoError(t, os.WriteFile(path, []byte("invalid"), 0o600))
+
+	assert.ErrorContains(t, NewStore(path, 0).Load(), "invalid replay store")
+}
@@ -1,10 +1,18 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/ezoidc/ezoidc/pkg/engine"
+	"github.com/ezoidc/ezoidc/pkg/krl"
 	"github.com/ezoidc/ezoidc/pkg/models"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -12,11 +20,19 @@ import (
 )
 
 var APIVersion = "1.0"
+
 var MaxBodySize int64 = 1024 * 1024 * 5 // 5MB
 
+const (
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	TokenTypeJWT           = "urn:ietf:params:oauth:token-type:jwt"
+	TokenTypeIDToken       = "urn:ietf:params:oauth:token-type:id_token"
+)
+
 type API struct {
-	Gin    *gin.Engine
-	Engine *engine.Engine
+	Gin          *gin.Engine
+	Engine       *engine.Engine
+	ReplayStores ReplayStores
 }
 
 func NewAPI(eng *engine.Engine) *API {
@@ -26,6 +42,8 @@ func NewAPI(eng *engine.Engine) *API {
 	router.Use(requestID())
 	router.Use(jsonLogs())
 
+	replayStores := NewReplayStores(eng.Configuration)
+
 	public := router.Group("/ezoidc")
 	public.GET("/", func(c *gin.Context) {
 		c.JSON(200, models.MetadataResponse{
@@ -34,6 +52,134 @@ func NewAPI(eng *engine.Engine) *API {
 		})
 	})
 
+	// Revoked SSH certificates, fetched by hosts for sshd RevokedKeys
+	if eng.Configuration != nil && eng.Configuration.SSHStore != "" {
+		store := krl.NewStore(eng.Configuration.SSHStore)
+		public.GET("/1.0/ssh/krl", func(c *gin.Context) {
+			data, err := store.KRL()
+			if err != nil {
+				log.Error().Err(err).Msg("failed to generate krl")
+				c.JSON(500, models.ErrorResponse{Error: "failed to generate krl"})
+				return
+			}
+			c.Data(200, "application/octet-stream", data)
+		})
+	}
+
+	// OIDC discovery of the keys signing the tokens minted by the policy
+	if eng.Signing != nil {
+		issuer := strings.TrimSuffix(eng.Signing.Issuer, "/")
+		base := "/"
+		if u, err := url.Parse(issuer); err == nil {
+			base = "/" + strings.Trim(u.Path, "/")
+		}
+		wellKnown := router.Group(base).Group("/.well-known")
+		wellKnown.GET("/openid-configuration", func(c *gin.Context) {
+			c.JSON(200, models.OpenIDConfiguration{
+				Issuer:                           eng.Signing.Issuer,
+				JWKSURI:                          issuer + "/.well-known/jwks.json",
+				ResponseTypesSupported:           []string{"id_token"},
+				SubjectTypesSupported:            []string{"public"},
+				IDTokenSigningAlgValuesSupported: []string{string(eng.Signing.Algorithm())},
+			})
+		})
+		wellKnown.GET("/jwks.json", func(c *gin.Context) {
+			jwks, err := eng.Signing.JWKS()
+			if err != nil {
+				log.Error().Err(err).Msg("failed to rotate signing keys")
+				c.JSON(500, models.ErrorResponse{Error: "failed to load signing keys"})
+				return
+			}
+			c.JSON(200, jwks)
+		})
+	}
+
+	// RFC 8693 token exchange of the OIDC token for a token from the exchange rule
+	public.POST("/token", func(c *gin.Context) {
+		if c.PostForm("grant_type") != GrantTypeTokenExchange {
+			oauthError(c, "unsupported_grant_type", "grant_type must be "+GrantTypeTokenExchange)
+			return
+		}
+		subjectToken := c.PostForm("subject_token")
+		if subjectToken == "" {
+			oauthError(c, "invalid_request", "subject_token is required")
+			return
+		}
+		switch c.PostForm("subject_token_type") {
+		case TokenTypeJWT, TokenTypeIDToken:
+		default:
+			oauthError(c, "invalid_request", "subject_token_type must be "+TokenTypeJWT+" or "+TokenTypeIDToken)
+			return
+		}
+
+		req := &engine.ExchangeRequest{
+			Audience:           c.PostFormArray("audience"),
+			Resource:           c.PostFormArray("resource"),
+			Scope:              strings.Fields(c.PostForm("scope")),
+			RequestedTokenType: c.PostForm("requested_token_type"),
+		}
+		if len(req.Audience) > 0 {
+			req.Target = req.Audience[0]
+		} else if len(req.Resource) > 0 {
+			req.Target = req.Resource[0]
+		} else {
+			oauthError(c, "invalid_request", "audience or resource is required")
+			return
+		}
+
+		claims, reason, err := verifyToken(c, eng.Configuration, subjectToken)
+		if err == nil {
+			// only valid requests use up the token
+			reason, err = useToken(c, replayStores)
+		}
+		if reason == ReasonReplayFull {
+			c.Set("reason", reason)
+			c.Header("Cache-Control", "no-store")
+			c.JSON(503, models.OAuthErrorResponse{Error: "temporarily_unavailable", ErrorDescription: err.Error()})
+			return
+		}
+		if err != nil {
+			c.Set("reason", reason)
+			oauthError(c, "invalid_request", err.Error())
+			return
+		}
+		c.Set("claims", claims)
+		req.Claims = claims
+
+		response, err := eng.ExchangeToken(c, req)
+		var limitErr *models.LimitError
+		if errors.As(err, &limitErr) {
+			c.Set("reason", limitErr.Reason)
+			c.Header("Cache-Control", "no-store")
+			c.JSON(503, models.OAuthErrorResponse{Error: "temporarily_unavailable", ErrorDescription: limitErr.Error()})
+			return
+		}
+		if errors.Is(err, engine.ErrExchangeDenied) {
+			oauthError(c, "invalid_target", err.Error())
+			return
+		}
+		if errors.Is(err, engine.ErrUnsupportedTokenType) {
+			oauthError(c, "invalid_request", err.Error())
+			return
+		}
+		if err != nil {
+			// evaluation errors may reveal policy or provider details, keep them in the logs
+			log.Error().Err(err).Str("target", req.Target).Msg("failed to exchange token")
+			oauthError(c, "invalid_request", "token exchange failed")
+			return
+		}
+		c.Set("allowed", map[string]string{req.Target: "exchange"})
+
+		c.Header("Cache-Control", "no-store")
+		c.JSON(200, models.TokenExchangeResponse{
+			AccessToken:     response.Token,
+			IssuedTokenType: response.IssuedTokenType,
+			TokenType:       response.TokenType,
+			ExpiresIn:       response.ExpiresIn,
+			Scope:           response.Scope,
+		})
+	})
+
 	auth := public.Group("/1.0", BearerToken(), ValidToken(eng.Configuration))
 	auth.Match([]string{"GET", "POST"}, "/variables", func(c *gin.Context) {
 		var body models.VariablesRequest
@@ -50,12 +196,18 @@ func NewAPI(eng *engine.Engine) *API {
 			}
 			c.Set("params", params)
 		}
+		if !useBearerToken(c, replayStores) {
+			return
+		}
 
 		claims := c.GetStringMap("claims")
 		response, err := eng.ReadVariables(c, &engine.ReadRequest{
 			Claims: claims,
 			Params: body.Params,
 		})
+		if limitError(c, err) {
+			return
+		}
 		if err != nil {
 			c.JSON(400, models.ErrorResponse{Error: err.Error()})
 			return
@@ -65,13 +217,99 @@ func NewAPI(eng *engine.Engine) *API {
 		c.JSON(200, models.VariablesResponse{Variables: response.Variables})
 	})
 
-	return &API{router, eng}
+	auth.PUT("/variables/:name", func(c *gin.Context) {
+		var body models.WriteVariableRequest
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(400, models.ErrorResponse{
+				Error: fmt.Sprintf("invalid JSON request body: %s", err.Error()),
+			})
+			return
+		}
+		params := []string{}
+		for k := range body.Params {
+			params = append(params, k)
+		}
+		c.Set("params", params)
+		if !useBearerToken(c, replayStores) {
+			return
+		}
+
+		name := c.Param("name")
+		err := eng.WriteVariable(c, &engine.WriteRequest{
+			Claims: c.GetStringMap("claims"),
+			Params: body.Params,
+			Name:   name,
+			Value:  body.Value,
+		})
+		switch {
+		case limitError(c, err):
+			return
+		case errors.Is(err, engine.ErrWriteDenied):
+			c.JSON(403, models.ErrorResponse{Error: err.Error()})
+			return
+		case errors.Is(err, engine.ErrWriteFailed):
+			// provider errors may reveal infrastructure details, keep them in the logs
+			log.Error().Err(err).Str("variable", name).Msg("failed to write variable")
+			c.JSON(502, models.ErrorResponse{Error: engine.ErrWriteFailed.Error()})
+			return
+		case err != nil:
+			c.JSON(400, models.ErrorResponse{Error: err.Error()})
+			return
+		}
+		c.Set("allowed", map[string]string{name: "write"})
+
+		c.Status(204)
+	})
+
+	return &API{router, eng, replayStores}
 }
 
+// Respond to an evaluation aborted by one of its limits, false for other errors
+func limitError(c *gin.Context, err error) bool {
+	var limitErr *models.LimitError
+	if !errors.As(err, &limitErr) {
+		return false
+	}
+	c.Set("reason", limitErr.Reason)
+	c.JSON(503, models.ErrorResponse{Error: limitErr.Error(), Reason: limitErr.Reason})
+	return true
+}
+
+func oauthError(c *gin.Context, code string, description string) {
+	c.Header("Cache-Control", "no-store")
+	c.JSON(400, models.OAuthErrorResponse{Error: code, ErrorDescription: description})
+}
+
+// Serve the API until interrupted, snapshotting the replay stores meanwhile
 func (a *API) Run() error {
+	if err := a.ReplayStores.Load(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	addr := a.Engine.Configuration.Listen
+	srv := &http.Server{Addr: addr, Handler: a.Gin.Handler()}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Shutdown(context.Background())
+	}()
+
+	snapshots := make(chan struct{})
+	go func() {
+		a.ReplayStores.SnapshotEvery(ctx, ReplaySnapshotInterval)
+		close(snapshots)
+	}()
+
 	log.Info().Str("address", addr).Msg("starting api server")
-	return a.Gin.Run(addr)
+	err := srv.ListenAndServe()
+	stop()
+	<-snapshots
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
 func jsonLogs() gin.HandlerFunc {
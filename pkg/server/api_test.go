@@ -3,19 +3,29 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
 	"time"
 
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
 	"github.com/ezoidc/ezoidc/pkg/engine"
+	"github.com/ezoidc/ezoidc/pkg/krl"
 	"github.com/ezoidc/ezoidc/pkg/models"
 	"github.com/gin-gonic/gin"
 	"github.com/go-jose/go-jose/v4"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
 )
 
 func init() {
@@ -51,7 +61,12 @@ func TestReadVariables(t *testing.T) {
 		Policy: `
 			allow.read("public") if not params.name
 			allow.read("param") if params.name = "param"
+			allow.read(name) if {
+				params.name == "errors"
+				count([code | some digits in numbers.range(1, 2); code := totp_generate({"secret": "JBSWY3DPEHPK3PXP", "digits": digits})]) == 0
+			}
 		`,
+		Limits: &models.Limits{MaxBuiltinErrors: 1},
 		Variables: models.Variables{
 			{
 				Name: "public",
@@ -115,6 +130,16 @@ func TestReadVariables(t *testing.T) {
 			request:  "invalid json",
 			response: `{"error":"invalid JSON request body: invalid character 'i' looking for beginning of value"}`,
 		},
+		"limit": {
+			claims: map[string]any{
+				"iss": issuer,
+				"aud": audience,
+				"exp": time.Now().Add(time.Minute).Unix(),
+			},
+			code:     503,
+			request:  `{"params":{"name":"errors"}}`,
+			response: `{"error":"evaluation exceeded the limit of 1 builtin errors","reason":"limit:builtin_errors"}`,
+		},
 	}
 	e := engine.NewEngine(cfg)
 	err := e.Compile(ctx)
@@ -135,6 +160,394 @@ func TestReadVariables(t *testing.T) {
 	}
 }
 
+func TestWriteVariable(t *testing.T) {
+	ctx := context.TODO()
+	issuer := "http://mock"
+	audience := "http://ezoidc"
+	cfg := &models.Configuration{
+		Audience: []string{audience},
+		Issuers: map[string]*models.Issuer{
+			"mock": {
+				Name:   "mock",
+				Issuer: issuer,
+				JWKS:   &models.JWKS{Keys: jwks.Keys},
+			},
+		},
+		Algorithms: []jose.SignatureAlgorithm{"RS256"},
+		Policy: `
+			allow.write("secret") if params.env == "prod"
+			allow.write("public")
+			allow.write("broken")
+			allow.write("missing")
+		`,
+		Variables: models.Variables{
+			{
+				Name: "secret",
+				Value: models.VariableValue{
+					Provider: "env",
+					ID:       "SECRET",
+				},
+			},
+			{
+				Name: "public",
+				Value: models.VariableValue{
+					Provider: "string",
+					ID:       "value",
+				},
+			},
+			{
+				Name: "broken",
+				Value: models.VariableValue{
+					Provider: "failing",
+					ID:       "arn:aws:ssm:us-east-1:123456789012:parameter/broken",
+				},
+			},
+		},
+	}
+	claims := map[string]any{
+		"iss": issuer,
+		"aud": audience,
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+	cases := map[string]struct {
+		name     string
+		code     int
+		request  string
+		response string
+	}{
+		"denied": {
+			name:     "secret",
+			code:     403,
+			request:  `{"value":"new"}`,
+			response: `{"error":"write denied by policy"}`,
+		},
+		"not found": {
+			name:     "missing",
+			code:     403,
+			request:  `{"value":"new"}`,
+			response: `{"error":"write denied by policy"}`,
+		},
+		"provider error": {
+			name:     "broken",
+			code:     502,
+			request:  `{"value":"new"}`,
+			response: `{"error":"failed to write variable"}`,
+		},
+		"not writable": {
+			name:     "public",
+			code:     400,
+			request:  `{"value":"new"}`,
+			response: `{"error":"variable provider does not support writes"}`,
+		},
+		"invalid json": {
+			name:     "public",
+			code:     400,
+			request:  "invalid json",
+			response: `{"error":"invalid JSON request body: invalid character 'i' looking for beginning of value"}`,
+		},
+	}
+	e := engine.NewEngine(cfg)
+	e.Resolver.Add("failing", &failingWriter{})
+	err := e.Compile(ctx)
+	assert.NoError(t, err)
+	api := NewAPI(e)
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(ctx, "PUT", "/ezoidc/1.0/variables/"+c.name, bytes.NewBuffer([]byte(c.request)))
+			req.Header.Set("Authorization", "Bearer "+sign(claims))
+			api.Gin.ServeHTTP(w, req)
+			assert.Equal(t, c.code, w.Code)
+			assert.Equal(t, c.response, w.Body.String())
+		})
+	}
+}
+
+type failingWriter struct{}
+
+func (p *failingWriter) Read(ctx context.Context, variables map[string]string) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (p *failingWriter) Write(ctx context.Context, id string, value string) error {
+	return fmt.Errorf("AccessDeniedException: not authorized to perform ssm:PutParameter on %s", id)
+}
+
+func TestTokenExchange(t *testing.T) {
+	ctx := context.TODO()
+	issuer := "http://mock"
+	audience := "http://ezoidc"
+	cfg := &models.Configuration{
+		Audience: []string{audience},
+		Issuers: map[string]*models.Issuer{
+			"mock": {
+				Name:   "mock",
+				Issuer: issuer,
+				JWKS:   &models.JWKS{Keys: jwks.Keys},
+			},
+		},
+		Algorithms: []jose.SignatureAlgorithm{"RS256"},
+		Policy: `
+			allow.internal("api_key")
+
+			exchange["https://api.example.com"] := read("api_key") if claims.sub == "repo"
+
+			exchange["urn:invalid"] := {"token": 1}
+
+			exchange["urn:limit"] := concat("", [totp_generate({}) | some _ in numbers.range(1, 2)])
+
+			exchange["urn:resource"] := {
+				"token": concat(" ", exchange_request.scope),
+				"expires_in": 60,
+				"scope": "read",
+			}
+		`,
+		Variables: models.Variables{
+			{Name: "api_key", Value: models.VariableValue{Provider: "string", ID: "secret"}},
+		},
+		Limits: &models.Limits{MaxBuiltinErrors: 1},
+	}
+	token := sign(map[string]any{
+		"iss": issuer,
+		"aud": audience,
+		"sub": "repo",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	exchange := url.Values{
+		"grant_type":         {GrantTypeTokenExchange},
+		"subject_token":      {token},
+		"subject_token_type": {TokenTypeJWT},
+	}
+	with := func(values url.Values) url.Values {
+		form := url.Values{}
+		for k, v := range exchange {
+			form[k] = v
+		}
+		for k, v := range values {
+			form[k] = v
+		}
+		return form
+	}
+
+	cases := map[string]struct {
+		form     url.Values
+		code     int
+		response string
+	}{
+		"audience": {
+			form:     with(url.Values{"audience": {"https://api.example.com"}}),
+			code:     200,
+			response: `{"access_token":"secret","issued_token_type":"urn:ietf:params:oauth:token-type:access_token","token_type":"Bearer"}`,
+		},
+		"resource": {
+			form:     with(url.Values{"resource": {"urn:resource"}, "scope": {"read write"}}),
+			code:     200,
+			response: `{"access_token":"read write","issued_token_type":"urn:ietf:params:oauth:token-type:access_token","token_type":"Bearer","expires_in":60,"scope":"read"}`,
+		},
+		"requested token type": {
+			form:     with(url.Values{"audience": {"https://api.example.com"}, "requested_token_type": {engine.TokenTypeAccessToken}}),
+			code:     200,
+			response: `{"access_token":"secret","issued_token_type":"urn:ietf:params:oauth:token-type:access_token","token_type":"Bearer"}`,
+		},
+		"unsupported token type": {
+			form:     with(url.Values{"audience": {"https://api.example.com"}, "requested_token_type": {TokenTypeJWT}}),
+			code:     400,
+			response: `{"error":"invalid_request","error_description":"unsupported requested_token_type: urn:ietf:params:oauth:token-type:jwt"}`,
+		},
+		"limit": {
+			form:     with(url.Values{"audience": {"urn:limit"}}),
+			code:     503,
+			response: `{"error":"temporarily_unavailable","error_description":"evaluation exceeded the limit of 1 builtin errors"}`,
+		},
+		"invalid result": {
+			form:     with(url.Values{"audience": {"urn:invalid"}}),
+			code:     400,
+			response: `{"error":"invalid_request","error_description":"token exchange failed"}`,
+		},
+		"denied": {
+			form:     with(url.Values{"audience": {"https://other.example.com"}}),
+			code:     400,
+			response: `{"error":"invalid_target","error_description":"token exchange denied by policy"}`,
+		},
+		"no target": {
+			form:     exchange,
+			code:     400,
+			response: `{"error":"invalid_request","error_description":"audience or resource is required"}`,
+		},
+		"grant type": {
+			form:     with(url.Values{"grant_type": {"client_credentials"}}),
+			code:     400,
+			response: `{"error":"unsupported_grant_type","error_description":"grant_type must be urn:ietf:params:oauth:grant-type:token-exchange"}`,
+		},
+		"subject token type": {
+			form:     with(url.Values{"subject_token_type": {"urn:ietf:params:oauth:token-type:saml2"}}),
+			code:     400,
+			response: `{"error":"invalid_request","error_description":"subject_token_type must be urn:ietf:params:oauth:token-type:jwt or urn:ietf:params:oauth:token-type:id_token"}`,
+		},
+		"invalid subject token": {
+			form:     with(url.Values{"subject_token": {"invalid"}, "audience": {"https://api.example.com"}}),
+			code:     400,
+			response: `{"error":"invalid_request","error_description":"invalid token or algorithm"}`,
+		},
+	}
+	e := engine.NewEngine(cfg)
+	err := e.Compile(ctx)
+	assert.NoError(t, err)
+	api := NewAPI(e)
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequestWithContext(ctx, "POST", "/ezoidc/token", strings.NewReader(c.form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			api.Gin.ServeHTTP(w, req)
+			assert.Equal(t, c.code, w.Code)
+			assert.Equal(t, c.response, w.Body.String())
+			assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+		})
+	}
+}
+
+func TestReplayInvalidRequest(t *testing.T) {
+	ctx := context.TODO()
+	issuer := "http://mock"
+	audience := "http://ezoidc"
+	cfg := &models.Configuration{
+		Audience: []string{audience},
+		Issuers: map[string]*models.Issuer{
+			"mock": {
+				Name:   "mock",
+				Issuer: issuer,
+				JWKS:   &models.JWKS{Keys: jwks.Keys},
+				Replay: &models.ReplayProtection{MaxUses: 1},
+			},
+		},
+		Algorithms: []jose.SignatureAlgorithm{"RS256"},
+		Policy: `
+			allow.read("api_key")
+			exchange["https://api.example.com"] := read("api_key")
+		`,
+		Variables: models.Variables{
+			{Name: "api_key", Value: models.VariableValue{Provider: "string", ID: "secret"}},
+		},
+	}
+	e := engine.NewEngine(cfg)
+	err := e.Compile(ctx)
+	assert.NoError(t, err)
+	api := NewAPI(e)
+	newToken := func() string {
+		return sign(map[string]any{
+			"iss": issuer,
+			"aud": audience,
+			"sub": "repo",
+			"exp": time.Now().Add(time.Minute).Unix(),
+			"jti": uuid.NewString(),
+		})
+	}
+
+	// a request rejected before evaluation does not use up the token
+	exchange := func(form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequestWithContext(ctx, "POST", "/ezoidc/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		api.Gin.ServeHTTP(w, req)
+		return w
+	}
+	form := url.Values{
+		"grant_type":         {GrantTypeTokenExchange},
+		"subject_token":      {newToken()},
+		"subject_token_type": {TokenTypeJWT},
+	}
+	w := exchange(form)
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, `{"error":"invalid_request","error_description":"audience or resource is required"}`, w.Body.String())
+	form.Set("audience", "https://api.example.com")
+	assert.Equal(t, 200, exchange(form).Code)
+	w = exchange(form)
+	assert.Equal(t, 400, w.Code)
+	assert.Equal(t, `{"error":"invalid_request","error_description":"token was already used"}`, w.Body.String())
+
+	variables := func(token string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequestWithContext(ctx, "POST", "/ezoidc/1.0/variables", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		api.Gin.ServeHTTP(w, req)
+		return w
+	}
+	token := newToken()
+	assert.Equal(t, 400, variables(token, "{").Code)
+	assert.Equal(t, 200, variables(token, "{}").Code)
+	w = variables(token, "{}")
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, `{"error":"token was already used","reason":"invalid:replay"}`, w.Body.String())
+}
+
+func TestSSHKRL(t *testing.T) {
+	ctx := context.TODO()
+	storePath := filepath.Join(t.TempDir(), "ssh.json")
+	store := krl.NewStore(storePath)
+	_, caKey, _ := ed25519.GenerateKey(rand.Reader)
+	caPublicKey, _ := ssh.NewPublicKey(caKey.Public())
+	err := store.Record(krl.Record{
+		Serial:      42,
+		KeyID:       "deploy",
+		CAKey:       string(ssh.MarshalAuthorizedKey(caPublicKey)),
+		ValidBefore: time.Now().Add(time.Hour),
+	})
+	assert.NoError(t, err)
+	_, err = store.Revoke(krl.Filter{Serials: []uint64{42}})
+	assert.NoError(t, err)
+
+	api := NewAPI(engine.NewEngine(&models.Configuration{SSHStore: storePath}))
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/ezoidc/1.0/ssh/krl", nil)
+	api.Gin.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/octet-stream", w.Header().Get("Content-Type"))
+	expected, err := store.KRL()
+	assert.NoError(t, err)
+	// the KRL version and generation date change every second
+	assert.Equal(t, expected[28:], w.Body.Bytes()[28:])
+
+	api = NewAPI(engine.NewEngine(&models.Configuration{}))
+	w = httptest.NewRecorder()
+	api.Gin.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestOpenIDConfiguration(t *testing.T) {
+	ctx := context.TODO()
+	e := engine.NewEngine(&models.Configuration{
+		Signing: &models.Signing{Issuer: "https://ezoidc.example.com/tokens", Algorithm: jose.ES256},
+	})
+	assert.NoError(t, e.Compile(ctx))
+	api := NewAPI(e)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/tokens/.well-known/openid-configuration", nil)
+	api.Gin.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{
+		"issuer": "https://ezoidc.example.com/tokens",
+		"jwks_uri": "https://ezoidc.example.com/tokens/.well-known/jwks.json",
+		"response_types_supported": ["id_token"],
+		"subject_types_supported": ["public"],
+		"id_token_signing_alg_values_supported": ["ES256"]
+	}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequestWithContext(ctx, "GET", "/tokens/.well-known/jwks.json", nil)
+	api.Gin.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	var jwks jose.JSONWebKeySet
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &jwks))
+	if assert.Len(t, jwks.Keys, 2) {
+		assert.True(t, jwks.Keys[0].IsPublic())
+		assert.Equal(t, "ES256", jwks.Keys[0].Algorithm)
+	}
+}
+
 func TestMaxBodySize(t *testing.T) {
 	ctx := context.TODO()
 	cfg := &models.Configuration{}
@@ -1,21 +1,31 @@
 package server
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"strings"
 	"time"
 
 	"github.com/ezoidc/ezoidc/pkg/models"
+	"github.com/ezoidc/ezoidc/pkg/replay"
 	"github.com/gin-gonic/gin"
 	"github.com/go-jose/go-jose/v4"
 	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/rs/zerolog/log"
 )
 
 const (
 	ReasonInvalidJwt    = "invalid:jwt"
 	ReasonInvalidKid    = "invalid:kid"
 	ReasonInvalidClaims = "invalid:claims"
+	ReasonInvalidReplay = "invalid:replay"
+	ReasonReplayFull    = "replay:full"
 )
 
+// Clock skew tolerated when validating the time claims of tokens
+const tokenLeeway = time.Minute
+
 func BearerToken() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authorization := c.GetHeader("Authorization")
@@ -36,45 +46,116 @@ func BearerToken() gin.HandlerFunc {
 
 func ValidToken(config *models.Configuration) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		bearerToken := c.GetString("bearer_token")
-		token, err := jwt.ParseSigned(bearerToken, config.Algorithms)
+		claims, reason, err := verifyToken(c, config, c.GetString("bearer_token"))
 		if err != nil {
-			authError(c, "invalid token or algorithm", ReasonInvalidJwt)
+			authError(c, err.Error(), reason)
 			return
 		}
 
-		var claims jwt.Claims
-		_ = token.UnsafeClaimsWithoutVerification(&claims)
+		c.Set("claims", claims)
+	}
+}
 
-		issuer := config.GetIssuer(claims.Issuer)
-		if issuer == nil {
-			c.Set("issuer", claims.Issuer)
-			authError(c, "invalid token issuer", reasonFromError(jwt.ErrInvalidIssuer))
-			return
-		}
-		c.Set("issuer", issuer.Name)
+// Token verified for the request, used once the request is known to be valid
+type verifiedToken struct {
+	issuer *models.Issuer
+	claims jwt.Claims
+	raw    string
+}
 
-		// verify token signature
-		var validatedClaims map[string]interface{}
-		err = token.Claims(jose.JSONWebKeySet(*issuer.JWKS), &validatedClaims)
-		if err != nil {
-			authError(c, err.Error(), ReasonInvalidKid)
-			return
-		}
+// Verify the signature and claims of a token issued by a configured issuer.
+// The use of the token is recorded separately by useToken.
+func verifyToken(c *gin.Context, config *models.Configuration, rawToken string) (map[string]any, string, error) {
+	token, err := jwt.ParseSigned(rawToken, config.Algorithms)
+	if err != nil {
+		return nil, ReasonInvalidJwt, errors.New("invalid token or algorithm")
+	}
 
-		// verify token claims
-		err = claims.ValidateWithLeeway(jwt.Expected{
-			Issuer:      issuer.Issuer,
-			AnyAudience: jwt.Audience(config.Audience),
-			Time:        time.Now(),
-		}, time.Minute)
-		if err != nil {
-			authError(c, err.Error(), reasonFromError(err))
-			return
-		}
+	var claims jwt.Claims
+	_ = token.UnsafeClaimsWithoutVerification(&claims)
+
+	issuer := config.GetIssuer(claims.Issuer)
+	if issuer == nil {
+		c.Set("issuer", claims.Issuer)
+		return nil, reasonFromError(jwt.ErrInvalidIssuer), errors.New("invalid token issuer")
+	}
+	c.Set("issuer", issuer.Name)
+
+	// verify token signature
+	var validatedClaims map[string]interface{}
+	err = token.Claims(jose.JSONWebKeySet(*issuer.JWKS), &validatedClaims)
+	if err != nil {
+		return nil, ReasonInvalidKid, err
+	}
 
-		c.Set("claims", validatedClaims)
+	// verify token claims
+	err = claims.ValidateWithLeeway(jwt.Expected{
+		Issuer:      issuer.Issuer,
+		AnyAudience: jwt.Audience(config.Audience),
+		Time:        time.Now(),
+	}, tokenLeeway)
+	if err != nil {
+		return nil, reasonFromError(err), err
+	}
+
+	c.Set("token", &verifiedToken{issuer: issuer, claims: claims, raw: rawToken})
+	return validatedClaims, "", nil
+}
+
+// Record the use of the bearer token once the request is known to be valid,
+// false after responding with the rejection of the replay protection
+func useBearerToken(c *gin.Context, stores ReplayStores) bool {
+	reason, err := useToken(c, stores)
+	if reason == ReasonReplayFull {
+		c.Set("reason", reason)
+		c.AbortWithStatusJSON(503, models.ErrorResponse{Error: err.Error(), Reason: reason})
+		return false
+	}
+	if err != nil {
+		authError(c, err.Error(), reason)
+		return false
+	}
+	return true
+}
+
+// Record the use of the token verified for the request with the replay store of its issuer
+func useToken(c *gin.Context, stores ReplayStores) (string, error) {
+	value, _ := c.Get("token")
+	token, ok := value.(*verifiedToken)
+	if !ok {
+		return ReasonInvalidJwt, errors.New("token was not verified")
+	}
+	if store := stores[token.issuer.Name]; store != nil {
+		return recordTokenUse(store, token.issuer, &token.claims, token.raw)
+	}
+	return "", nil
+}
+
+// Record a use of the token until it expires, identified by its jti or its hash.
+// A full store rejects the token rather than forgetting the uses of others.
+func recordTokenUse(store *replay.Store, issuer *models.Issuer, claims *jwt.Claims, rawToken string) (string, error) {
+	if claims.Expiry == nil {
+		return ReasonInvalidReplay, errors.New("token without exp cannot be protected against replay")
+	}
+	id := "token:" + rawToken
+	if claims.ID != "" {
+		id = "jti:" + claims.ID
+	}
+	sum := sha256.Sum256([]byte(issuer.Issuer + "\n" + id))
+
+	maxUses := issuer.Replay.MaxUses
+	if maxUses <= 0 {
+		maxUses = 1
+	}
+	ok, err := store.Use(hex.EncodeToString(sum[:]), claims.Expiry.Time().Add(tokenLeeway), maxUses)
+	if err != nil {
+		log.Error().Err(err).Str("issuer", issuer.Name).Msg("failed to record token use")
+		return ReasonReplayFull, err
+	}
+	if !ok {
+		return ReasonInvalidReplay, errors.New("token was already used")
 	}
+	return "", nil
 }
 
 func authError(ctx *gin.Context, err string, reason string) {
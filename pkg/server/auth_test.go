@@ -210,6 +210,71 @@ func TestValidToken(t *testing.T) {
 	}
 }
 
+func TestReplayProtection(t *testing.T) {
+	issuer := "http://127.0.0.1:3000"
+	cfg := &models.Configuration{
+		Audience: []string{issuer},
+		Issuers: map[string]*models.Issuer{
+			"mock": {
+				Name:   "mock",
+				Issuer: issuer,
+				JWKS:   &models.JWKS{Keys: jwks.Keys},
+				Replay: &models.ReplayProtection{MaxUses: 2, MaxEntries: 3},
+			},
+		},
+		Algorithms: []jose.SignatureAlgorithm{"RS256"},
+	}
+
+	g := gin.Default()
+	g.Use(BearerToken())
+	stores := NewReplayStores(cfg)
+	g.Use(ValidToken(cfg))
+	g.GET("/", func(c *gin.Context) {
+		if !useBearerToken(c, stores) {
+			return
+		}
+		c.JSON(200, gin.H{"ezoidc": true})
+	})
+	request := func(token string) (int, string) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		req.Header.Set("Authorization", "Bearer "+token)
+		g.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	exp := time.Now().Add(time.Minute).Unix()
+	token := sign(map[string]any{"iss": issuer, "aud": issuer, "exp": exp})
+	for _, code := range []int{200, 200, 401} {
+		status, body := request(token)
+		assert.Equal(t, code, status)
+		if code == 401 {
+			assert.Equal(t, `{"error":"token was already used","reason":"invalid:replay"}`, body)
+		}
+	}
+
+	// tokens sharing a jti are the same token
+	status, _ := request(sign(map[string]any{"iss": issuer, "aud": issuer, "exp": exp, "jti": "1", "n": 1}))
+	assert.Equal(t, 200, status)
+	status, _ = request(sign(map[string]any{"iss": issuer, "aud": issuer, "exp": exp, "jti": "1", "n": 2}))
+	assert.Equal(t, 200, status)
+	status, _ = request(sign(map[string]any{"iss": issuer, "aud": issuer, "exp": exp, "jti": "1", "n": 3}))
+	assert.Equal(t, 401, status)
+	status, _ = request(sign(map[string]any{"iss": issuer, "aud": issuer, "exp": exp, "jti": "2"}))
+	assert.Equal(t, 200, status)
+
+	status, body := request(sign(map[string]any{"iss": issuer, "aud": issuer}))
+	assert.Equal(t, 401, status)
+	assert.Equal(t, `{"error":"token without exp cannot be protected against replay","reason":"invalid:replay"}`, body)
+
+	// a full store rejects new tokens without forgetting the used ones
+	status, body = request(sign(map[string]any{"iss": issuer, "aud": issuer, "exp": exp, "jti": "3"}))
+	assert.Equal(t, 503, status)
+	assert.Equal(t, `{"error":"replay store is full","reason":"replay:full"}`, body)
+	status, _ = request(token)
+	assert.Equal(t, 401, status)
+}
+
 func TestBearerToken(t *testing.T) {
 	cases := map[string]struct {
 		header string
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/ezoidc/ezoidc/pkg/models"
+	"github.com/ezoidc/ezoidc/pkg/replay"
+	"github.com/rs/zerolog/log"
+)
+
+// Interval between the snapshots of the replay stores to their files
+var ReplaySnapshotInterval = 10 * time.Second
+
+// Stores of the token uses by issuer name, for the issuers with replay protection
+type ReplayStores map[string]*replay.Store
+
+func NewReplayStores(config *models.Configuration) ReplayStores {
+	stores := ReplayStores{}
+	if config == nil {
+		return stores
+	}
+	for _, issuer := range config.Issuers {
+		if issuer.Replay != nil {
+			stores[issuer.Name] = replay.NewStore(issuer.Replay.Path, issuer.Replay.MaxEntries)
+		}
+	}
+	return stores
+}
+
+// Load the snapshots of the stores
+func (s ReplayStores) Load() error {
+	for _, store := range s {
+		if err := store.Load(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot the stores until ctx is done, and a last time before returning
+func (s ReplayStores) SnapshotEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.snapshot()
+			return
+		case <-ticker.C:
+			s.snapshot()
+		}
+	}
+}
+
+func (s ReplayStores) snapshot() {
+	for name, store := range s {
+		if err := store.Snapshot(); err != nil {
+			log.Error().Err(err).Str("issuer", name).Msg("failed to snapshot replay store")
+		}
+	}
+}
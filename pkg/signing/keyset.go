@@ -0,0 +1,245 @@
+// Package signing manages the keys used to sign the tokens minted by ezoidc
+// and publishes them as a JWKS.
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ezoidc/ezoidc/pkg/models"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const DefaultRotationPeriod = 24 * time.Hour
+
+// Signing keys, either read from files or generated and rotated in memory.
+//
+// Generated keys are published one rotation period before they start signing
+// and remain published one period after, so that relying parties caching the
+// JWKS can always verify tokens that live at most one period.
+type KeySet struct {
+	Issuer string
+
+	algorithm jose.SignatureAlgorithm
+	rotation  time.Duration
+	generated bool
+
+	mu sync.Mutex
+	// The first key signs, all of them are published
+	keys []*signingKey
+	// Generated keys published before and after they sign
+	next, previous *signingKey
+	rotatedAt      time.Time
+}
+
+type signingKey struct {
+	jwk jose.JSONWebKey
+}
+
+func NewKeySet(config *models.Signing) (*KeySet, error) {
+	if config.Issuer == "" {
+		return nil, fmt.Errorf("signing: issuer must not be empty")
+	}
+
+	k := &KeySet{
+		Issuer:    config.Issuer,
+		algorithm: config.Algorithm,
+		rotation:  config.RotationPeriod,
+	}
+
+	if len(config.Keys) == 0 {
+		if k.algorithm == "" {
+			k.algorithm = jose.RS256
+		}
+		if k.rotation <= 0 {
+			k.rotation = DefaultRotationPeriod
+		}
+		k.generated = true
+
+		current, err := k.generate()
+		if err != nil {
+			return nil, err
+		}
+		next, err := k.generate()
+		if err != nil {
+			return nil, err
+		}
+		k.keys = []*signingKey{current}
+		k.next = next
+		k.rotatedAt = time.Now()
+		return k, nil
+	}
+
+	for _, keyConfig := range config.Keys {
+		data, err := os.ReadFile(keyConfig.Path)
+		if err != nil {
+			return nil, fmt.Errorf("signing: %w", err)
+		}
+		private, err := ParsePrivateKey(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("signing: invalid key %s: %w", keyConfig.Path, err)
+		}
+		algorithm := config.Algorithm
+		if algorithm == "" {
+			algorithm, err = DefaultAlgorithm(private)
+			if err != nil {
+				return nil, fmt.Errorf("signing: invalid key %s: %w", keyConfig.Path, err)
+			}
+		}
+		key, err := newSigningKey(private, algorithm, keyConfig.ID)
+		if err != nil {
+			return nil, fmt.Errorf("signing: invalid key %s: %w", keyConfig.Path, err)
+		}
+		k.keys = append(k.keys, key)
+	}
+	k.algorithm = k.keys[0].algorithm()
+
+	return k, nil
+}
+
+// Sign the claims with the current key, returns the token and key ID
+func (k *KeySet) Sign(claims map[string]any) (string, string, error) {
+	k.mu.Lock()
+	err := k.rotate(time.Now())
+	key := k.keys[0]
+	k.mu.Unlock()
+	if err != nil {
+		return "", "", err
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: key.algorithm(), Key: key.jwk},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		return "", "", err
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	return token, key.jwk.KeyID, err
+}
+
+// Public keys to verify the minted tokens
+func (k *KeySet) JWKS() (*jose.JSONWebKeySet, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.rotate(time.Now()); err != nil {
+		return nil, err
+	}
+
+	jwks := &jose.JSONWebKeySet{}
+	keys := k.keys
+	if k.generated {
+		keys = []*signingKey{k.keys[0], k.next}
+		if k.previous != nil {
+			keys = append(keys, k.previous)
+		}
+	}
+	for _, key := range keys {
+		jwks.Keys = append(jwks.Keys, key.jwk.Public())
+	}
+	return jwks, nil
+}
+
+// Signature algorithm of the signing key
+func (k *KeySet) Algorithm() jose.SignatureAlgorithm {
+	return k.algorithm
+}
+
+// Longest lifetime of the minted tokens, zero when unlimited
+func (k *KeySet) MaxTTL() time.Duration {
+	if k.generated {
+		return k.rotation
+	}
+	return 0
+}
+
+// Promote the next key once the current one has signed for a rotation period
+func (k *KeySet) rotate(now time.Time) error {
+	if !k.generated || now.Sub(k.rotatedAt) < k.rotation {
+		return nil
+	}
+
+	next, err := k.generate()
+	if err != nil {
+		return err
+	}
+	k.previous = k.keys[0]
+	k.keys[0] = k.next
+	k.next = next
+	k.rotatedAt = now
+	return nil
+}
+
+func (k *KeySet) generate() (*signingKey, error) {
+	var private crypto.Signer
+	var err error
+	switch k.algorithm {
+	case jose.RS256, jose.RS384, jose.RS512, jose.PS256, jose.PS384, jose.PS512:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case jose.ES256:
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jose.ES384:
+		private, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case jose.ES512:
+		private, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case jose.EdDSA:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("signing: unsupported algorithm %s", k.algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newSigningKey(private, k.algorithm, "")
+}
+
+func newSigningKey(private crypto.Signer, algorithm jose.SignatureAlgorithm, id string) (*signingKey, error) {
+	jwk := jose.JSONWebKey{Key: private, Algorithm: string(algorithm), Use: "sig"}
+	if id == "" {
+		thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		id = base64.RawURLEncoding.EncodeToString(thumbprint)
+	}
+	jwk.KeyID = id
+	if !jwk.Valid() {
+		return nil, fmt.Errorf("unsupported key type %T", private)
+	}
+	return &signingKey{jwk: jwk}, nil
+}
+
+func (s *signingKey) algorithm() jose.SignatureAlgorithm {
+	return jose.SignatureAlgorithm(s.jwk.Algorithm)
+}
+
+// Signature algorithm of a private key, RS256 for RSA keys
+func DefaultAlgorithm(key crypto.Signer) (jose.SignatureAlgorithm, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return jose.ES256, nil
+		case elliptic.P384():
+			return jose.ES384, nil
+		case elliptic.P521():
+			return jose.ES512, nil
+		}
+	case ed25519.PrivateKey:
+		return jose.EdDSA, nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
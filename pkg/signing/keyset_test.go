@@ -0,0 +1,110 @@
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ezoidc/ezoidc/pkg/models"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/stretchr/testify/assert"
+)
+
+func verify(t *testing.T, k *KeySet, token string) map[string]any {
+	t.Helper()
+
+	jwks, err := k.JWKS()
+	assert.NoError(t, err)
+	parsed, err := jwt.ParseSigned(token, []jose.SignatureAlgorithm{k.Algorithm()})
+	assert.NoError(t, err)
+	claims := map[string]any{}
+	assert.NoError(t, parsed.Claims(jwks, &claims))
+	return claims
+}
+
+func TestGeneratedKeys(t *testing.T) {
+	_, err := NewKeySet(&models.Signing{})
+	assert.ErrorContains(t, err, "issuer must not be empty")
+
+	_, err = NewKeySet(&models.Signing{Issuer: "https://ezoidc", Algorithm: "HS256"})
+	assert.ErrorContains(t, err, "unsupported algorithm")
+
+	k, err := NewKeySet(&models.Signing{Issuer: "https://ezoidc", Algorithm: jose.ES256, RotationPeriod: time.Hour})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, k.MaxTTL())
+
+	jwks, err := k.JWKS()
+	assert.NoError(t, err)
+	assert.Len(t, jwks.Keys, 2, "current and next keys")
+
+	token, kid, err := k.Sign(map[string]any{"sub": "test"})
+	assert.NoError(t, err)
+	assert.Equal(t, jwks.Keys[0].KeyID, kid)
+	assert.Equal(t, "test", verify(t, k, token)["sub"])
+
+	// tokens of the previous key still verify after rotation
+	k.rotatedAt = k.rotatedAt.Add(-time.Hour)
+	jwks, err = k.JWKS()
+	assert.NoError(t, err)
+	assert.Len(t, jwks.Keys, 3, "current, next and previous keys")
+	assert.Equal(t, kid, jwks.Keys[2].KeyID)
+	assert.Equal(t, "test", verify(t, k, token)["sub"])
+
+	_, rotatedKid, err := k.Sign(map[string]any{"sub": "test"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, kid, rotatedKid)
+	assert.Equal(t, jwks.Keys[0].KeyID, rotatedKid)
+
+	k.rotatedAt = k.rotatedAt.Add(-time.Hour)
+	jwks, err = k.JWKS()
+	assert.NoError(t, err)
+	for _, key := range jwks.Keys {
+		assert.NotEqual(t, kid, key.KeyID, "retired key is no longer published")
+	}
+}
+
+func TestFileKeys(t *testing.T) {
+	dir := t.TempDir()
+	paths := []string{}
+	for i := 0; i < 2; i++ {
+		key, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		assert.NoError(t, err)
+		path := filepath.Join(dir, fmt.Sprintf("key%d.pem", i))
+		assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+		paths = append(paths, path)
+	}
+
+	k, err := NewKeySet(&models.Signing{
+		Issuer: "https://ezoidc",
+		Keys:   []models.SigningKey{{Path: paths[0], ID: "current"}, {Path: paths[1]}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, jose.ES384, k.Algorithm())
+	assert.Equal(t, time.Duration(0), k.MaxTTL())
+
+	jwks, err := k.JWKS()
+	assert.NoError(t, err)
+	if assert.Len(t, jwks.Keys, 2) {
+		assert.Equal(t, "current", jwks.Keys[0].KeyID)
+		assert.NotEmpty(t, jwks.Keys[1].KeyID)
+		assert.True(t, jwks.Keys[0].IsPublic())
+		assert.Equal(t, "sig", jwks.Keys[0].Use)
+	}
+
+	token, kid, err := k.Sign(map[string]any{"sub": "test"})
+	assert.NoError(t, err)
+	assert.Equal(t, "current", kid)
+	assert.Equal(t, "test", verify(t, k, token)["sub"])
+
+	_, err = NewKeySet(&models.Signing{Issuer: "https://ezoidc", Keys: []models.SigningKey{{Path: filepath.Join(dir, "missing.pem")}}})
+	assert.Error(t, err)
+}